@@ -0,0 +1,422 @@
+// Personal Access Tokens
+//
+// Named, scoped, expiring credentials for CI pipelines and robot accounts.
+// A token looks like "eoci_<id>_<secret>" and is used as the password in
+// Basic auth (docker login) or at the token endpoint. Only a SHA-256 hash of
+// the secret is stored, in the metadata KV store under "pats/<id>".
+//
+// A token acts as its owner, limited to its own scopes. Every use re-reads
+// the record, so revocation takes effect immediately, including for bearer
+// tokens issued in exchange for it.
+//
+//	GET    /v2/_edgeoci/tokens          list (own tokens; admins see all)
+//	POST   /v2/_edgeoci/tokens          create (admins may create for other accounts)
+//	DELETE /v2/_edgeoci/tokens/<id>     revoke (owner or admin)
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// Prefix identifying an access token in place of a password
+	AccessTokenPrefix = "eoci_"
+
+	// Token lifetimes
+	DefaultAccessTokenLifetime = 90 * 24 * time.Hour
+	MaxAccessTokenLifetime     = 365 * 24 * time.Hour
+
+	// last_used_at is only rewritten when older than this, to spare KV writes
+	AccessTokenLastUsedResolution = 5 * time.Minute
+
+	// Maximum scopes per token
+	MaxAccessTokenScopes = 32
+)
+
+// AccessTokenRecord is a stored personal access token ("pats/<id>")
+type AccessTokenRecord struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	Owner      string        `json:"owner"`
+	SecretHash string        `json:"secret_hash"` // sha256 hex of the secret part
+	Scopes     []AccessEntry `json:"scopes"`
+	CreatedAt  string        `json:"created_at"`
+	CreatedBy  string        `json:"created_by"`
+	ExpiresAt  string        `json:"expires_at"`
+	LastUsedAt string        `json:"last_used_at,omitempty"`
+}
+
+// AccessTokenInfo is a token as returned by the API (no hash)
+type AccessTokenInfo struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Owner      string   `json:"owner"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	CreatedBy  string   `json:"created_by"`
+	ExpiresAt  string   `json:"expires_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	Token      string   `json:"token,omitempty"` // Only in the create response
+}
+
+// AccessTokenList response for GET /v2/_edgeoci/tokens
+type AccessTokenList struct {
+	Tokens []AccessTokenInfo `json:"tokens"`
+}
+
+// AccessTokenCreate is the body of a token POST
+type AccessTokenCreate struct {
+	Name      string   `json:"name"`
+	Owner     string   `json:"owner"`      // Defaults to the caller
+	Scopes    []string `json:"scopes"`     // e.g. "repository:team-a/app:pull,push"; none = owner's full access
+	ExpiresIn int64    `json:"expires_in"` // Seconds; defaults to 90 days
+}
+
+func accessTokenKey(id string) string {
+	return fmt.Sprintf("pats/%s", id)
+}
+
+func hashAccessTokenSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// isAccessToken reports whether a password is an access token
+func isAccessToken(password string) bool {
+	return strings.HasPrefix(password, AccessTokenPrefix)
+}
+
+// parseAccessToken splits "eoci_<id>_<secret>" into id and secret
+func parseAccessToken(token string) (id, secret string, ok bool) {
+	rest := strings.TrimPrefix(token, AccessTokenPrefix)
+	id, secret, ok = strings.Cut(rest, "_")
+	if !ok || len(id) != 16 || secret == "" {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+func (t *AccessTokenRecord) info() AccessTokenInfo {
+	scopes := make([]string, 0, len(t.Scopes))
+	for _, s := range t.Scopes {
+		scopes = append(scopes, formatScopes([]AccessEntry{s}))
+	}
+	return AccessTokenInfo{
+		ID:         t.ID,
+		Name:       t.Name,
+		Owner:      t.Owner,
+		Scopes:     scopes,
+		CreatedAt:  t.CreatedAt,
+		CreatedBy:  t.CreatedBy,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+	}
+}
+
+// expired reports whether the token is past its expiry
+func (t *AccessTokenRecord) expired(now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, t.ExpiresAt)
+	return err != nil || !now.Before(expires)
+}
+
+// loadAccessToken loads a stored token record (nil if it doesn't exist)
+func loadAccessToken(store *kvstore.Store, id string) *AccessTokenRecord {
+	entry, err := store.Lookup(accessTokenKey(id))
+	if err != nil {
+		return nil
+	}
+	body, _ := io.ReadAll(entry)
+	var record AccessTokenRecord
+	if json.Unmarshal(body, &record) != nil || record.ID != id {
+		return nil
+	}
+	return &record
+}
+
+// saveAccessToken stores a token record
+func saveAccessToken(store *kvstore.Store, record *AccessTokenRecord) error {
+	value, _ := json.Marshal(record)
+	if err := store.Insert(accessTokenKey(record.ID), strings.NewReader(string(value))); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	return nil
+}
+
+// deleteAccessToken removes a token record and its index entry
+func deleteAccessToken(store *kvstore.Store, id string) error {
+	if err := store.Delete(accessTokenKey(id)); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV delete error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	return accessTokenIndex(store).Remove(id)
+}
+
+// authenticateAccessToken checks an access token presented as a Basic password.
+// The username must be the token's owner.
+func authenticateAccessToken(username, token string) *AuthResult {
+	id, secret, ok := parseAccessToken(token)
+	if !ok {
+		return nil
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil
+	}
+
+	record := loadAccessToken(store, id)
+	if record == nil || !SecureCompare(hashAccessTokenSecret(secret), record.SecretHash) {
+		return nil
+	}
+	if record.Owner != username {
+		LogSecurityEvent("PAT_OWNER_MISMATCH", "", fmt.Sprintf("token=%s owner=%s user=%s", id, record.Owner, username))
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if record.expired(now) {
+		return nil
+	}
+
+	owner, ok := lookupAccount(record.Owner)
+	if !ok {
+		return nil
+	}
+
+	// Record use, coarsely
+	if last, err := time.Parse(time.RFC3339, record.LastUsedAt); err != nil || now.Sub(last) > AccessTokenLastUsedResolution {
+		record.LastUsedAt = now.Format(time.RFC3339)
+		saveAccessToken(store, record)
+	}
+
+	// A token without scopes carries its owner's full repository access
+	var limits []AccessEntry
+	if len(record.Scopes) > 0 {
+		limits = record.Scopes
+	}
+	return &AuthResult{Authenticated: true, Username: record.Owner, Groups: owner.Groups, Robot: owner.Robot, TokenID: id, Limits: limits}
+}
+
+// accessTokenActive reports whether a token still exists and is unexpired
+// (checked for bearer tokens issued in exchange for it)
+func accessTokenActive(id string) bool {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return false
+	}
+	record := loadAccessToken(store, id)
+	return record != nil && !record.expired(time.Now().UTC())
+}
+
+// revokeAccountTokens deletes every token owned by an account
+func revokeAccountTokens(store *kvstore.Store, owner string) error {
+	ids, err := accessTokenIndex(store).List()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if record := loadAccessToken(store, id); record != nil && record.Owner == owner {
+			if err := deleteAccessToken(store, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// requirePasswordLogin rejects token management and password changes through
+// tokens, so a scoped credential can't mint broader ones or take over its owner
+func requirePasswordLogin(auth *AuthResult) error {
+	if AuthEnabled && (auth.Claims != nil || auth.TokenID != "" || auth.Anonymous) {
+		return &OCIError{Code: "DENIED", Message: "this operation requires a password login", Status: fsthttp.StatusForbidden}
+	}
+	return nil
+}
+
+// parseTokenScopes parses and validates requested token scopes
+func parseTokenScopes(scopes []string) ([]AccessEntry, error) {
+	if len(scopes) > MaxAccessTokenScopes {
+		return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("at most %d scopes allowed", MaxAccessTokenScopes), Status: fsthttp.StatusBadRequest}
+	}
+
+	var entries []AccessEntry
+	for _, s := range scopes {
+		entry := parseScope(s)
+		if entry != nil && entry.Type == ScopeTypeRegistry && entry.Name == RegistryCatalog && len(entry.Actions) == 1 && entry.Actions[0] == "*" {
+			entries = append(entries, *entry)
+			continue
+		}
+		if entry == nil || entry.Type != ScopeTypeRepository || entry.Name == "" || len(entry.Actions) == 0 {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: "invalid scope, expected repository:<name>:<actions> or registry:catalog:*", Detail: s, Status: fsthttp.StatusBadRequest}
+		}
+		for _, action := range entry.Actions {
+			if action != "*" && !containsAction(repositoryActions, action) {
+				return nil, &OCIError{Code: "UNSUPPORTED", Message: "unknown action in scope", Detail: s, Status: fsthttp.StatusBadRequest}
+			}
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+// handleListAccessTokens handles GET /v2/_edgeoci/tokens
+func handleListAccessTokens(_ context.Context, w fsthttp.ResponseWriter, auth *AuthResult) error {
+	if err := requirePasswordLogin(auth); err != nil {
+		return err
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	ids, err := accessTokenIndex(store).List()
+	if err != nil {
+		return err
+	}
+
+	admin := isAdmin(auth)
+	response := AccessTokenList{Tokens: []AccessTokenInfo{}}
+	for _, id := range ids {
+		record := loadAccessToken(store, id)
+		if record == nil || (!admin && record.Owner != auth.Username) {
+			continue
+		}
+		response.Tokens = append(response.Tokens, record.info())
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	return nil
+}
+
+// handleCreateAccessToken handles POST /v2/_edgeoci/tokens
+func handleCreateAccessToken(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, auth *AuthResult) error {
+	if err := requirePasswordLogin(auth); err != nil {
+		return err
+	}
+
+	var req AccessTokenCreate
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: "invalid token request", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+	}
+
+	if req.Name == "" || len(req.Name) > 128 {
+		return &OCIError{Code: "UNSUPPORTED", Message: "token name must be 1 to 128 characters", Status: fsthttp.StatusBadRequest}
+	}
+
+	owner := req.Owner
+	if owner == "" {
+		owner = auth.Username
+	}
+	if owner != auth.Username && !isAdmin(auth) {
+		return adminRequiredError()
+	}
+	if _, ok := lookupAccount(owner); !ok {
+		return userUnknownError(owner)
+	}
+
+	scopes, err := parseTokenScopes(req.Scopes)
+	if err != nil {
+		return err
+	}
+
+	lifetime := DefaultAccessTokenLifetime
+	if req.ExpiresIn > 0 {
+		lifetime = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if lifetime > MaxAccessTokenLifetime {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("expires_in may be at most %d seconds", int64(MaxAccessTokenLifetime/time.Second)), Status: fsthttp.StatusBadRequest}
+	}
+
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("random source error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("random source error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	now := time.Now().UTC()
+	record := &AccessTokenRecord{
+		ID:         id,
+		Name:       req.Name,
+		Owner:      owner,
+		SecretHash: hashAccessTokenSecret(secret),
+		Scopes:     scopes,
+		CreatedAt:  now.Format(time.RFC3339),
+		CreatedBy:  auth.Username,
+		ExpiresAt:  now.Add(lifetime).Format(time.RFC3339),
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if err := saveAccessToken(store, record); err != nil {
+		return err
+	}
+	if err := accessTokenIndex(store).Add(id); err != nil {
+		return err
+	}
+
+	LogSecurityEvent("PAT_CREATED", getClientIP(r), fmt.Sprintf("token=%s name=%q owner=%s scopes=%d expires=%s by=%s", id, req.Name, owner, len(scopes), record.ExpiresAt, auth.Username))
+
+	response := record.info()
+	response.Token = AccessTokenPrefix + id + "_" + secret
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(fsthttp.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+	return nil
+}
+
+// handleRevokeAccessToken handles DELETE /v2/_edgeoci/tokens/<id>
+func handleRevokeAccessToken(_ context.Context, w fsthttp.ResponseWriter, id string, auth *AuthResult) error {
+	if err := requirePasswordLogin(auth); err != nil {
+		return err
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	record := loadAccessToken(store, id)
+	if record == nil || (record.Owner != auth.Username && !isAdmin(auth)) {
+		return &OCIError{Code: "NAME_UNKNOWN", Message: "access token unknown", Detail: id, Status: fsthttp.StatusNotFound}
+	}
+
+	if err := deleteAccessToken(store, id); err != nil {
+		return err
+	}
+
+	LogSecurityEvent("PAT_REVOKED", "", fmt.Sprintf("token=%s owner=%s by=%s", id, record.Owner, auth.Username))
+
+	w.WriteHeader(fsthttp.StatusAccepted)
+	return nil
+}
@@ -1,7 +1,8 @@
 // Authentication Middleware
 //
 // Provides optional Basic Authentication for the registry.
-// Credentials are stored in Fastly Secret Store.
+// Bootstrap credentials are stored in Fastly Secret Store; further
+// accounts live in the user store (users.go).
 
 package main
 
@@ -21,19 +22,41 @@ const (
 	// Secret store keys for credentials
 	AuthUsernameKey = "REGISTRY_USERNAME"
 	AuthPasswordKey = "REGISTRY_PASSWORD"
+
+	// Account name of unauthenticated callers
+	AnonymousAccount = "anonymous"
 )
 
 type AuthResult struct {
 	Authenticated bool
 	Username      string
+	Groups        []string
+	Anonymous     bool          // No credentials were presented (public pull)
+	Robot         bool          // Robot account (rate limit tier)
+	TokenID       string        // Personal access token used as the password
+	Limits        []AccessEntry // Scope ceiling of that token (nil = unlimited)
+	Federated     bool          // Identity asserted by a trusted OIDC issuer
+	RetryAfter    int           // Seconds until a login lockout ends
 	Claims        *TokenClaims
 	Error         *OCIError
 }
 
-// CheckAuth validates the Authorization header (Basic or Bearer)
+// CheckAuth validates the Authorization header (Basic or Bearer) of a
+// registry request. OIDC logins are refused: federated callers exchange their
+// CI token at the token endpoint and use the short-lived registry token.
 func CheckAuth(r *fsthttp.Request) *AuthResult {
+	return checkAuthHeader(r, false)
+}
+
+// CheckTokenEndpointAuth validates the Authorization header of a token
+// request, where Basic logins may also present an OIDC token as user "oidc"
+func CheckTokenEndpointAuth(r *fsthttp.Request) *AuthResult {
+	return checkAuthHeader(r, true)
+}
+
+func checkAuthHeader(r *fsthttp.Request, allowFederated bool) *AuthResult {
 	if !AuthEnabled {
-		return &AuthResult{Authenticated: true, Username: "anonymous"}
+		return &AuthResult{Authenticated: true, Username: AnonymousAccount}
 	}
 
 	authHeader := r.Header.Get("Authorization")
@@ -93,8 +116,23 @@ func CheckAuth(r *fsthttp.Request) *AuthResult {
 	username := parts[0]
 	password := parts[1]
 
-	// Validate against Secret Store
-	if !validateCredentials(username, password) {
+	if username == OIDCLoginUsername && !allowFederated {
+		return &AuthResult{
+			Authenticated: false,
+			Error: &OCIError{
+				Code:    "UNAUTHORIZED",
+				Message: "OIDC tokens are only accepted at the token endpoint",
+				Status:  fsthttp.StatusUnauthorized,
+			},
+		}
+	}
+
+	// Validate against the bootstrap account, user store and access tokens
+	result, retryAfter := authenticateLogin(username, password, getClientIP(r))
+	if retryAfter > 0 {
+		return &AuthResult{Authenticated: false, Error: lockedOutError(retryAfter), RetryAfter: retryAfter}
+	}
+	if result == nil {
 		return &AuthResult{
 			Authenticated: false,
 			Error: &OCIError{
@@ -105,56 +143,122 @@ func CheckAuth(r *fsthttp.Request) *AuthResult {
 		}
 	}
 
-	return &AuthResult{Authenticated: true, Username: username}
+	return result
 }
 
-// validateCredentials checks username/password against Secret Store
+// authenticateCredentials checks a username with a password or personal access token
+func authenticateCredentials(username, password string) *AuthResult {
+	if username == OIDCLoginUsername {
+		auth, err := authenticateOIDC(password)
+		if err != nil {
+			fmt.Printf("OIDC: login rejected: %v\n", err)
+			return nil
+		}
+		return auth
+	}
+	if isAccessToken(password) {
+		return authenticateAccessToken(username, password)
+	}
+
+	groups, ok := authenticateUser(username, password)
+	if !ok {
+		return nil
+	}
+	return &AuthResult{Authenticated: true, Username: username, Groups: groups}
+}
+
+// validateCredentials checks username/password against the bootstrap account in Secret Store
 func validateCredentials(username, password string) bool {
+	expectedUsername, expectedPassword, ok := loadBootstrapCredentials()
+	if !ok {
+		return false
+	}
+
+	// Use constant-time comparison to prevent timing attacks
+	return SecureCompare(username, expectedUsername) && SecureCompare(password, expectedPassword)
+}
+
+// loadBootstrapCredentials reads the bootstrap account from Secret Store
+func loadBootstrapCredentials() (username, password string, ok bool) {
 	store, err := secretstore.Open(SecretStoreName)
 	if err != nil {
-		fmt.Printf("Auth: Secret store not available - rejecting all credentials\n")
+		fmt.Printf("Auth: Secret store not available - rejecting bootstrap credentials\n")
 		// No fallback - secret store is required for production
-		return false
+		return "", "", false
 	}
 
 	// Get expected username
 	usernameSecret, err := store.Get(AuthUsernameKey)
 	if err != nil {
 		fmt.Printf("Auth: Username secret not found - configure REGISTRY_USERNAME in secret store\n")
-		return false
+		return "", "", false
 	}
 
 	expectedUsername, err := usernameSecret.Plaintext()
 	if err != nil {
-		return false
+		return "", "", false
 	}
 
 	// Get expected password
 	passwordSecret, err := store.Get(AuthPasswordKey)
 	if err != nil {
 		fmt.Printf("Auth: Password secret not found\n")
-		return false
+		return "", "", false
 	}
 
 	expectedPassword, err := passwordSecret.Plaintext()
 	if err != nil {
-		return false
+		return "", "", false
 	}
 
 	// Clean up whitespace
-	expectedUsernameStr := strings.TrimSpace(string(expectedUsername))
-	expectedPasswordStr := strings.TrimSpace(string(expectedPassword))
-
-	// Use constant-time comparison to prevent timing attacks
-	return SecureCompare(username, expectedUsernameStr) && SecureCompare(password, expectedPasswordStr)
+	username = strings.TrimSpace(string(expectedUsername))
+	password = strings.TrimSpace(string(expectedPassword))
+	if username == "" || password == "" {
+		return "", "", false
+	}
+	return username, password, true
 }
 
-// WriteUnauthorizedResponse writes a 401 response with WWW-Authenticate header
-func WriteUnauthorizedResponse(w fsthttp.ResponseWriter, realm string) {
-	// Bearer challenge tells Docker where to get tokens
-	challenge := `Bearer realm="https://registry.aerosane.dev/v2/auth",service="registry.aerosane.dev"`
+// WriteUnauthorizedResponse writes a 401 response with a Bearer challenge.
+// scope is the access the request needed, authError an RFC 6750 error code
+// ("invalid_token", "insufficient_scope") or empty.
+func WriteUnauthorizedResponse(w fsthttp.ResponseWriter, r *fsthttp.Request, scope, authError string) {
+	// Bearer challenge tells Docker where to get tokens, and for what
+	challenge := fmt.Sprintf(`Bearer realm="%s",service="%s"`, tokenRealm(r), registryHost(r))
+	if scope != "" {
+		challenge += fmt.Sprintf(`,scope="%s"`, scope)
+	}
+	if authError != "" {
+		challenge += fmt.Sprintf(`,error="%s"`, authError)
+	}
 	w.Header().Set("WWW-Authenticate", challenge)
 	w.Header().Set("Content-Type", ContentTypeJSON)
 	w.WriteHeader(fsthttp.StatusUnauthorized)
+	if authError == "insufficient_scope" {
+		w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"insufficient scope"}]}`))
+		return
+	}
 	w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
 }
+
+// challengeScope returns the token scope a route requires, for auth challenges
+func challengeScope(route Route) string {
+	if route.Name == "" {
+		if resource := registryResource(route.Type); resource != "" {
+			return fmt.Sprintf("%s:%s:*", ScopeTypeRegistry, resource)
+		}
+		return ""
+	}
+	// The name is URL-decoded; never copy quotes or other characters a
+	// repository name can't hold into the header
+	if err := ValidateRepositoryName(route.Name); err != nil {
+		return ""
+	}
+	action := getRequiredAction(route.Type)
+	if action == ActionPush {
+		// Pushes read back what they upload; docker asks for both
+		action = ActionPull + "," + ActionPush
+	}
+	return fmt.Sprintf("%s:%s:%s", ScopeTypeRepository, route.Name, action)
+}
@@ -8,6 +8,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/fastly/compute-sdk-go/fsthttp"
@@ -188,10 +191,18 @@ func formatSize(bytes int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(bytes)/float64(div), "KMGTPE"[exp])
 }
 
-// PaginatedResponse adds pagination headers to a response
+// AddPaginationHeaders adds an RFC 5988 Link header pointing at the next page.
+// The cursor is query-escaped so tags and names survive the round trip.
 func AddPaginationHeaders(w fsthttp.ResponseWriter, name string, endpoint string, n int, last string, hasMore bool) {
 	if hasMore && last != "" {
-		linkURL := fmt.Sprintf("/v2/%s/%s?n=%d&last=%s", name, endpoint, n, last)
+		path := "/v2/" + name
+		if endpoint != "" {
+			path += "/" + endpoint
+		}
+		query := url.Values{}
+		query.Set("n", strconv.Itoa(n))
+		query.Set("last", last)
+		linkURL := path + "?" + query.Encode()
 		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, linkURL))
 	}
 }
@@ -218,30 +229,29 @@ func ParsePaginationParams(query string) (n int, last string) {
 	return n, last
 }
 
-// PaginateStringSlice paginates a slice of strings
+// PaginateStringSlice returns the page of items that sort lexically after last.
+// Items are sorted per the distribution spec, and last is treated as a lexical
+// cursor, so it doesn't need to be present in items.
 func PaginateStringSlice(items []string, n int, last string) (page []string, nextLast string, hasMore bool) {
-	startIdx := 0
+	sorted := make([]string, len(items))
+	copy(sorted, items)
+	sort.Strings(sorted)
 
-	// Find start position based on 'last' parameter
+	startIdx := 0
 	if last != "" {
-		for i, item := range items {
-			if item == last {
-				startIdx = i + 1
-				break
-			}
-		}
+		startIdx = sort.Search(len(sorted), func(i int) bool { return sorted[i] > last })
 	}
 
 	// Extract page
 	endIdx := startIdx + n
-	if endIdx > len(items) {
-		endIdx = len(items)
+	if endIdx > len(sorted) {
+		endIdx = len(sorted)
 	}
 
-	page = items[startIdx:endIdx]
+	page = sorted[startIdx:endIdx]
 
 	// Determine if there are more items
-	hasMore = endIdx < len(items)
+	hasMore = endIdx < len(sorted)
 	if hasMore && len(page) > 0 {
 		nextLast = page[len(page)-1]
 	}
@@ -0,0 +1,242 @@
+// Brute-Force Protection
+//
+// Counts failed password logins in the metadata KV store, so every edge
+// instance sees the same counts:
+//
+//	authfail/pair/<name>/<ip>  failures for an account from one client address
+//	authfail/user/<name>       failures for an account from anywhere
+//	authfail/ip/<ip>           failures from a client address
+//
+// The addresses with a pair counter for an account are kept in a set index
+// (see setindex.go), so an unlock can clear them.
+//
+// Once a counter reaches its threshold, further attempts are refused with
+// 429 TOOMANYREQUESTS for an exponentially growing period, even with the
+// right password. A guesser is stopped by the per-address counters long
+// before the account-wide one, which only trips on a distributed attack, so
+// a single client cannot lock someone else out of their account. Access
+// token and OIDC logins cannot be guessed, so they are neither counted nor
+// refused by any counter. Counters expire after a quiet period; a successful login
+// clears the account counters, and an administrator can unlock an account:
+//
+//	POST /v2/_edgeoci/users/<name>/unlock
+//
+// KV updates are not atomic, so concurrent failures may be undercounted;
+// the lockout is approximate by design.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// KV key prefixes (in the metadata store) for failure counters
+	AuthFailPairPrefix = "authfail/pair/"
+	AuthFailUserPrefix = "authfail/user/"
+	AuthFailIPPrefix   = "authfail/ip/"
+
+	// Failures before lockout; shared NAT gateways get a higher IP budget,
+	// and the account-wide lock needs failures from several addresses
+	AuthFailureThreshold        = 5
+	AuthFailureIPThreshold      = 20
+	AuthFailureAccountThreshold = 50
+
+	// Counters reset after this long without failures
+	AuthFailureWindow = 15 * 60 // seconds
+
+	// Lockout doubles with each failure past the threshold, up to the maximum
+	AuthLockoutBase = 30   // seconds
+	AuthLockoutMax  = 3600 // seconds
+)
+
+// authFailAddressIndex returns the index of addresses with a pair counter
+// for an account
+func authFailAddressIndex(store *kvstore.Store, name string) *setIndex {
+	return &setIndex{
+		store:  store,
+		prefix: "authfailindex/" + name,
+	}
+}
+
+// loginFailures is a stored failure counter
+type loginFailures struct {
+	Failures    int   `json:"failures"`
+	LastFailure int64 `json:"last_failure"`
+	LockedUntil int64 `json:"locked_until,omitempty"`
+}
+
+// retryAfter returns the seconds left in a lockout, or 0
+func (f *loginFailures) retryAfter(now int64) int {
+	if f == nil || f.LockedUntil <= now {
+		return 0
+	}
+	return int(f.LockedUntil - now)
+}
+
+// loadLoginFailures reads a failure counter, ignoring stale ones
+func loadLoginFailures(store *kvstore.Store, key string) *loginFailures {
+	entry, err := store.Lookup(key)
+	if err != nil {
+		return nil
+	}
+
+	body, _ := io.ReadAll(entry)
+	var f loginFailures
+	if err := json.Unmarshal(body, &f); err != nil {
+		return nil
+	}
+	now := time.Now().Unix()
+	if now >= f.LockedUntil && now-f.LastFailure > AuthFailureWindow {
+		return nil
+	}
+	return &f
+}
+
+// recordLoginFailure increments a counter, locking it out past threshold.
+// It returns the lockout duration started by this failure, or 0.
+func recordLoginFailure(store *kvstore.Store, key string, f *loginFailures, threshold int) int {
+	if f == nil {
+		f = &loginFailures{}
+	}
+	now := time.Now().Unix()
+	f.Failures++
+	f.LastFailure = now
+
+	lockout := 0
+	if f.Failures >= threshold {
+		lockout = AuthLockoutMax
+		if shift := f.Failures - threshold; shift < 8 && AuthLockoutBase<<shift < AuthLockoutMax {
+			lockout = AuthLockoutBase << shift
+		}
+		f.LockedUntil = now + int64(lockout)
+	}
+
+	data, _ := json.Marshal(f)
+	if err := store.Insert(key, strings.NewReader(string(data))); err != nil {
+		fmt.Printf("Failed to record login failure: %v\n", err)
+	}
+	return lockout
+}
+
+// authenticateLogin checks Basic or password-grant credentials, refusing
+// attempts while the account or client IP is locked out. It returns the
+// result (nil for bad credentials) and, when locked out, the seconds to wait.
+func authenticateLogin(username, password, ip string) (*AuthResult, int) {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		fmt.Printf("Login throttling unavailable: %v\n", err)
+		return authenticateCredentials(username, password), 0
+	}
+
+	// Access tokens and OIDC tokens cannot be guessed: no counter applies
+	if username == OIDCLoginUsername || isAccessToken(password) {
+		return authenticateCredentials(username, password), 0
+	}
+
+	// Only well-formed account names get account counters
+	type counter struct {
+		key       string
+		threshold int
+		label     string
+		failures  *loginFailures
+	}
+	var counters []*counter
+	pairKey := ""
+	if accountNamePattern.MatchString(username) {
+		if ip != "" {
+			pairKey = AuthFailPairPrefix + username + "/" + ip
+			counters = append(counters, &counter{key: pairKey, threshold: AuthFailureThreshold, label: "user=" + username + " ip=" + ip})
+		}
+		counters = append(counters, &counter{key: AuthFailUserPrefix + username, threshold: AuthFailureAccountThreshold, label: "user=" + username})
+	}
+	if ip != "" {
+		counters = append(counters, &counter{key: AuthFailIPPrefix + ip, threshold: AuthFailureIPThreshold, label: "ip=" + ip})
+	}
+
+	now := time.Now().Unix()
+	for _, c := range counters {
+		c.failures = loadLoginFailures(store, c.key)
+		if wait := c.failures.retryAfter(now); wait > 0 {
+			LogSecurityEvent("AUTH_THROTTLED", ip, fmt.Sprintf("user=%s retry_after=%d", username, wait))
+			return nil, wait
+		}
+	}
+
+	auth := authenticateCredentials(username, password)
+	if auth != nil {
+		// Clear the account counters; the address keeps its record
+		for _, c := range counters {
+			if c.failures != nil && !strings.HasPrefix(c.key, AuthFailIPPrefix) {
+				store.Delete(c.key)
+			}
+		}
+		return auth, 0
+	}
+
+	for _, c := range counters {
+		if c.key == pairKey && c.failures == nil {
+			// First failure from this address: remember it for unlocks
+			if err := authFailAddressIndex(store, username).Add(ip); err != nil {
+				fmt.Printf("Failed to index login failure: %v\n", err)
+			}
+		}
+		if lockout := recordLoginFailure(store, c.key, c.failures, c.threshold); lockout > 0 {
+			LogSecurityEvent("AUTH_LOCKOUT", ip, fmt.Sprintf("%s locked_for=%ds", c.label, lockout))
+		}
+	}
+	return nil, 0
+}
+
+// lockedOutError is returned for login attempts during a lockout
+func lockedOutError(retryAfter int) *OCIError {
+	return &OCIError{
+		Code:    "TOOMANYREQUESTS",
+		Message: fmt.Sprintf("too many failed logins, retry in %d seconds", retryAfter),
+		Status:  fsthttp.StatusTooManyRequests,
+	}
+}
+
+// handleUnlockUser handles POST /v2/_edgeoci/users/<name>/unlock
+func handleUnlockUser(_ context.Context, w fsthttp.ResponseWriter, name string, auth *AuthResult) error {
+	if !isAdmin(auth) {
+		return adminRequiredError()
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if err := store.Delete(AuthFailUserPrefix + name); err != nil && !errors.Is(err, kvstore.ErrKeyNotFound) {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	// Clear the counters of every address that failed for this account
+	index := authFailAddressIndex(store, name)
+	addresses, err := index.List()
+	if err != nil {
+		return err
+	}
+	for _, ip := range addresses {
+		if err := store.Delete(AuthFailPairPrefix + name + "/" + ip); err != nil && !errors.Is(err, kvstore.ErrKeyNotFound) {
+			return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
+		if err := index.Remove(ip); err != nil {
+			return err
+		}
+	}
+
+	LogSecurityEvent("ACCOUNT_UNLOCKED", "", fmt.Sprintf("user=%s by=%s", name, auth.Username))
+
+	w.WriteHeader(fsthttp.StatusNoContent)
+	return nil
+}
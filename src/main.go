@@ -17,6 +17,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/url"
 	"strings"
 
 	"github.com/fastly/compute-sdk-go/fsthttp"
@@ -28,6 +29,9 @@ const (
 	HeaderDockerAPIVersion    = "Docker-Distribution-API-Version"
 	ContentTypeJSON           = "application/json"
 	DockerAPIVersionValue     = "registry/2.0"
+
+	// Path namespace for this registry's extension endpoints
+	ExtensionNamespace = "_edgeoci"
 )
 
 func main() {
@@ -76,6 +80,11 @@ func parseRoute(path, method, query string) Route {
 		return Route{Type: "token_auth"}
 	}
 
+	// Public token signing keys: GET /.well-known/jwks.json
+	if path == JWKSPath && method == "GET" {
+		return Route{Type: "jwks"}
+	}
+
 	// API version check: GET /v2/
 	if path == "/v2/" || path == "/v2" {
 		return Route{Type: "api_version"}
@@ -93,6 +102,31 @@ func parseRoute(path, method, query string) Route {
 		return Route{Type: "catalog"}
 	}
 
+	// Registry extensions: GET /v2/_edgeoci/<extension path>
+	if strings.HasPrefix(pathWithoutV2, ExtensionNamespace+"/") {
+		return parseRegistryExtensionRoute(pathWithoutV2[len(ExtensionNamespace)+1:], method, query)
+	}
+
+	// Extension discovery: GET /v2/_oci/ext/discover or /v2/<name>/_oci/ext/discover
+	if pathWithoutV2 == OCIDiscoverEndpoint && method == "GET" {
+		return Route{Type: "ext_discover"}
+	}
+	if strings.HasSuffix(pathWithoutV2, "/"+OCIDiscoverEndpoint) && method == "GET" {
+		name := strings.TrimSuffix(pathWithoutV2, "/"+OCIDiscoverEndpoint)
+		if name != "" {
+			return Route{Type: "ext_discover", Name: name}
+		}
+	}
+
+	// Repository extensions: <name>/_edgeoci/<extension path>
+	if idx := strings.Index(pathWithoutV2, "/"+ExtensionNamespace+"/"); idx != -1 {
+		name := pathWithoutV2[:idx]
+		extPath := pathWithoutV2[idx+len(ExtensionNamespace)+2:]
+		if name != "" {
+			return parseRepositoryExtensionRoute(name, extPath, method, query)
+		}
+	}
+
 	// Manifest routes: <name>/manifests/<reference>
 	if idx := strings.Index(pathWithoutV2, "/manifests/"); idx != -1 {
 		name := pathWithoutV2[:idx]
@@ -100,9 +134,9 @@ func parseRoute(path, method, query string) Route {
 		if name != "" && reference != "" {
 			switch method {
 			case "GET":
-				return Route{Type: "get_manifest", Name: name, Reference: reference}
+				return Route{Type: "get_manifest", Name: name, Reference: reference, Query: query}
 			case "HEAD":
-				return Route{Type: "head_manifest", Name: name, Reference: reference}
+				return Route{Type: "head_manifest", Name: name, Reference: reference, Query: query}
 			case "PUT":
 				return Route{Type: "put_manifest", Name: name, Reference: reference}
 			case "DELETE":
@@ -189,6 +223,89 @@ func parseRoute(path, method, query string) Route {
 	return Route{Type: "not_found"}
 }
 
+// parseRepositoryExtensionRoute parses the path below /v2/<name>/_edgeoci/
+func parseRepositoryExtensionRoute(name, extPath, method, query string) Route {
+	// Tag history: tags/<tag>/history, tags/<tag>/rollback
+	if strings.HasPrefix(extPath, "tags/") {
+		rest := extPath[5:]
+		if idx := strings.LastIndex(rest, "/"); idx > 0 {
+			tag := rest[:idx]
+			switch {
+			case rest[idx+1:] == "history" && method == "GET":
+				return Route{Type: "tag_history", Name: name, Reference: tag, Query: query}
+			case rest[idx+1:] == "rollback" && method == "POST":
+				return Route{Type: "tag_rollback", Name: name, Reference: tag}
+			}
+		}
+	}
+
+	// Repository metadata: metadata
+	if extPath == "metadata" {
+		switch method {
+		case "GET":
+			return Route{Type: "get_repo_metadata", Name: name}
+		case "PUT":
+			return Route{Type: "put_repo_metadata", Name: name}
+		}
+	}
+
+	return Route{Type: "not_found"}
+}
+
+// parseRegistryExtensionRoute parses the path below /v2/_edgeoci/
+func parseRegistryExtensionRoute(extPath, method, query string) Route {
+	// Catalog with repository metadata and search
+	if extPath == "catalog" && method == "GET" {
+		return Route{Type: "catalog_ext", Query: query}
+	}
+
+	// Personal access tokens: tokens, tokens/<id>
+	if extPath == "tokens" {
+		switch method {
+		case "GET":
+			return Route{Type: "list_tokens"}
+		case "POST":
+			return Route{Type: "create_token"}
+		}
+	}
+	if strings.HasPrefix(extPath, "tokens/") && method == "DELETE" {
+		if id := extPath[7:]; id != "" && !strings.Contains(id, "/") {
+			return Route{Type: "revoke_token", Reference: id}
+		}
+	}
+
+	// Bearer token revocation
+	if extPath == "revocations" && method == "POST" {
+		return Route{Type: "create_revocation"}
+	}
+
+	// User accounts: users, users/<name>, users/<name>/password, users/<name>/unlock
+	if extPath == "users" && method == "GET" {
+		return Route{Type: "list_users"}
+	}
+	if strings.HasPrefix(extPath, "users/") {
+		user := extPath[6:]
+		if strings.HasSuffix(user, "/password") && method == "POST" {
+			return Route{Type: "reset_password", Reference: strings.TrimSuffix(user, "/password")}
+		}
+		if strings.HasSuffix(user, "/unlock") && method == "POST" {
+			return Route{Type: "unlock_user", Reference: strings.TrimSuffix(user, "/unlock")}
+		}
+		if user != "" && !strings.Contains(user, "/") {
+			switch method {
+			case "GET":
+				return Route{Type: "get_user", Reference: user}
+			case "PUT":
+				return Route{Type: "put_user", Reference: user}
+			case "DELETE":
+				return Route{Type: "delete_user", Reference: user}
+			}
+		}
+	}
+
+	return Route{Type: "not_found"}
+}
+
 func handleRoute(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, route Route) error {
 	if r.Method == "TRACE" {
 		w.WriteHeader(fsthttp.StatusMethodNotAllowed)
@@ -215,31 +332,90 @@ func handleRoute(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Reque
 		return nil
 	}
 
-	allowed, count, remaining := CheckRateLimit(r)
-	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", RateLimitMaxRequests))
-	w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
-	if !allowed {
-		LogSecurityEvent("RATE_LIMIT", getClientIP(r), fmt.Sprintf("exceeded %d requests", count))
-		WriteRateLimitResponse(w, RateLimitWindow)
+	limit := CheckRateLimit(r)
+	setRateLimitHeaders(w, limit)
+	if !limit.Allowed {
+		LogSecurityEvent("RATE_LIMIT", getClientIP(r), fmt.Sprintf("exceeded %d requests", limit.Limit))
+		WriteRateLimitResponse(w, limit)
 		return nil
 	}
 
+	// Fail closed: without a signing key no token can be trusted or issued
+	if AuthEnabled && route.Type != "health" {
+		if _, err := loadTokenKeys(); err != nil {
+			LogSecurityEvent("CONFIG_ERROR", getClientIP(r), err.Error())
+			return &OCIError{
+				Code:    "UNSUPPORTED",
+				Message: "registry token signing key is not configured",
+				Status:  fsthttp.StatusServiceUnavailable,
+			}
+		}
+	}
+
 	var authResult *AuthResult
-	if route.Type != "health" && route.Type != "api_version" && route.Type != "token_auth" {
+	if route.Type != "health" && route.Type != "api_version" && route.Type != "token_auth" && route.Type != "jwks" {
 		authResult = CheckAuth(r)
+		if !authResult.Authenticated {
+			authResult = anonymousAuth(r, route, authResult)
+		}
+		if authResult.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", authResult.RetryAfter))
+			return authResult.Error
+		}
 		if !authResult.Authenticated {
 			LogSecurityEvent("AUTH_FAIL", getClientIP(r), fmt.Sprintf("path=%s", r.URL.Path))
-			WriteUnauthorizedResponse(w, RegistryName)
+			authError := ""
+			if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				authError = "invalid_token"
+			}
+			WriteUnauthorizedResponse(w, r, challengeScope(route), authError)
 			return nil
 		}
 
-		if authResult.Claims != nil && route.Name != "" {
+		if route.Name != "" {
 			action := getRequiredAction(route.Type)
-			if !CheckAuthorization(authResult.Claims, route.Name, action) {
-				LogSecurityEvent("AUTHZ_DENIED", getClientIP(r), fmt.Sprintf("repo=%s action=%s", route.Name, action))
+			if !authorizeRequest(authResult, route.Name, action) {
+				LogSecurityEvent("AUTHZ_DENIED", getClientIP(r), fmt.Sprintf("repo=%s action=%s account=%s", route.Name, action, authResult.Username))
+				// A bearer token lacking the scope: tell docker which token to fetch
+				if authResult.Claims != nil {
+					WriteUnauthorizedResponse(w, r, challengeScope(route), "insufficient_scope")
+					return nil
+				}
 				WriteDeniedResponse(w, action, route.Name)
 				return nil
 			}
+		} else if resource := registryResource(route.Type); resource != "" {
+			if !authorizeRegistryRequest(authResult, resource) {
+				LogSecurityEvent("AUTHZ_DENIED", getClientIP(r), fmt.Sprintf("resource=%s:%s account=%s", ScopeTypeRegistry, resource, authResult.Username))
+				if authResult.Claims != nil {
+					WriteUnauthorizedResponse(w, r, challengeScope(route), "insufficient_scope")
+					return nil
+				}
+				WriteDeniedResponse(w, "*", ScopeTypeRegistry+":"+resource)
+				return nil
+			}
+		}
+
+		// Mounting needs pull on the source; otherwise fall back to a plain upload
+		if route.Type == "mount_blob" && !authorizeRequest(authResult, route.MountFrom, ActionPull) {
+			route = Route{Type: "initiate_upload", Name: route.Name}
+		}
+	}
+
+	account := AnonymousAccount
+	if authResult != nil && authResult.Username != "" {
+		account = authResult.Username
+	}
+
+	// Charge the caller's budget for this class of operation
+	if route.Type != "health" && route.Type != "token_auth" {
+		op, cost := routeOperation(route.Type)
+		budget := CheckOperationLimit(r, authResult, op, cost)
+		setRateLimitHeaders(w, budget)
+		if !budget.Allowed {
+			LogSecurityEvent("RATE_LIMIT", getClientIP(r), fmt.Sprintf("op=%s account=%s exceeded %d requests", op, account, budget.Limit))
+			WriteRateLimitResponse(w, budget)
+			return nil
 		}
 	}
 
@@ -267,22 +443,28 @@ func handleRoute(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Reque
 		return nil
 	case "token_auth":
 		return HandleTokenRequest(w, r)
+	case "jwks":
+		return handleJWKS(w)
 	case "api_version":
 		// /v2/ endpoint: Return 401 with Bearer challenge if not authenticated
 		// This is how Docker learns where to get tokens
 		authResult := CheckAuth(r)
+		if authResult.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", authResult.RetryAfter))
+			return authResult.Error
+		}
 		if !authResult.Authenticated {
-			WriteUnauthorizedResponse(w, RegistryName)
+			WriteUnauthorizedResponse(w, r, "", "")
 			return nil
 		}
 		WriteAPIVersionResponse(w)
 		return nil
 	case "get_manifest":
-		return handleGetManifest(ctx, w, route.Name, route.Reference)
+		return handleGetManifest(ctx, w, route.Name, route.Reference, route.Query)
 	case "head_manifest":
-		return handleHeadManifest(ctx, w, route.Name, route.Reference)
+		return handleHeadManifest(ctx, w, route.Name, route.Reference, route.Query)
 	case "put_manifest":
-		return handlePutManifest(ctx, w, r, route.Name, route.Reference)
+		return handlePutManifest(ctx, w, r, route.Name, route.Reference, account)
 	case "delete_manifest":
 		return handleDeleteManifest(ctx, w, route.Name, route.Reference)
 	case "get_blob":
@@ -307,6 +489,44 @@ func handleRoute(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Reque
 		return handleCatalog(ctx, w, r.URL.RawQuery)
 	case "referrers":
 		return handleReferrers(ctx, w, r, route.Name, route.Digest)
+	case "ext_discover":
+		return handleExtensionDiscovery(ctx, w, route.Name)
+	case "get_repo_metadata":
+		return handleGetRepositoryMetadata(ctx, w, route.Name)
+	case "put_repo_metadata":
+		return handlePutRepositoryMetadata(ctx, w, r, route.Name, account)
+	case "catalog_ext":
+		return handleCatalogExtension(ctx, w, route.Query, authResult)
+	case "list_tokens":
+		return handleListAccessTokens(ctx, w, authResult)
+	case "create_token":
+		return handleCreateAccessToken(ctx, w, r, authResult)
+	case "revoke_token":
+		return handleRevokeAccessToken(ctx, w, route.Reference, authResult)
+	case "create_revocation":
+		return handleCreateRevocation(ctx, w, r, authResult)
+	case "list_users":
+		return handleListUsers(ctx, w, authResult)
+	case "get_user", "put_user", "delete_user", "reset_password", "unlock_user":
+		if err := validateAccountName(route.Reference); err != nil {
+			return err
+		}
+		switch route.Type {
+		case "get_user":
+			return handleGetUser(ctx, w, route.Reference, authResult)
+		case "put_user":
+			return handlePutUser(ctx, w, r, route.Reference, authResult)
+		case "delete_user":
+			return handleDeleteUser(ctx, w, route.Reference, authResult)
+		case "unlock_user":
+			return handleUnlockUser(ctx, w, route.Reference, authResult)
+		default:
+			return handleResetPassword(ctx, w, r, route.Reference, authResult)
+		}
+	case "tag_history":
+		return handleTagHistory(ctx, w, route.Name, route.Reference)
+	case "tag_rollback":
+		return handleTagRollback(ctx, w, r, route.Name, route.Reference, account)
 	case "not_found":
 		return &OCIError{
 			Code:    "NAME_UNKNOWN",
@@ -326,8 +546,10 @@ func extractQueryParam(query, key string) string {
 	for _, pair := range strings.Split(query, "&") {
 		parts := strings.SplitN(pair, "=", 2)
 		if len(parts) == 2 && parts[0] == key {
-			// Basic URL decoding
-			return strings.ReplaceAll(strings.ReplaceAll(parts[1], "%3A", ":"), "%2F", "/")
+			if value, err := url.QueryUnescape(parts[1]); err == nil {
+				return value
+			}
+			return parts[1]
 		}
 	}
 	return ""
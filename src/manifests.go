@@ -10,6 +10,7 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -44,41 +45,10 @@ type Catalog struct {
 	Repositories []string `json:"repositories"`
 }
 
-func handleGetManifest(_ context.Context, w fsthttp.ResponseWriter, name, reference string) error {
-	store, err := kvstore.Open(KVStoreManifests)
+func handleGetManifest(_ context.Context, w fsthttp.ResponseWriter, name, reference, query string) error {
+	stored, manifestBytes, err := loadManifestForRequest(name, reference, query)
 	if err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
-	}
-
-	// Resolve tag to digest if needed
-	digest := reference
-	if !strings.HasPrefix(reference, "sha256:") {
-		resolved, err := resolveTag(name, reference)
-		if err != nil {
-			return err
-		}
-		digest = resolved
-	}
-
-	key := fmt.Sprintf("manifests/%s/%s", name, digest)
-	entry, err := store.Lookup(key)
-	if err != nil {
-		return &OCIError{Code: "MANIFEST_UNKNOWN", Message: "manifest unknown", Detail: reference, Status: fsthttp.StatusNotFound}
-	}
-
-	body, err := io.ReadAll(entry)
-	if err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read error: %v", err), Status: fsthttp.StatusInternalServerError}
-	}
-
-	var stored StoredManifest
-	if err := json.Unmarshal(body, &stored); err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid manifest data: %v", err), Status: fsthttp.StatusInternalServerError}
-	}
-
-	manifestBytes, err := base64.StdEncoding.DecodeString(stored.Content)
-	if err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Base64 decode error: %v", err), Status: fsthttp.StatusInternalServerError}
+		return err
 	}
 
 	w.Header().Set("Content-Type", stored.MediaType)
@@ -91,58 +61,85 @@ func handleGetManifest(_ context.Context, w fsthttp.ResponseWriter, name, refere
 	return nil
 }
 
-func handleHeadManifest(_ context.Context, w fsthttp.ResponseWriter, name, reference string) error {
-	store, err := kvstore.Open(KVStoreManifests)
+func handleHeadManifest(_ context.Context, w fsthttp.ResponseWriter, name, reference, query string) error {
+	stored, manifestBytes, err := loadManifestForRequest(name, reference, query)
 	if err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+		return err
 	}
 
+	// Use manual framing mode to preserve Content-Length on HEAD response
+	w.SetManualFramingMode(true)
+	w.Header().Set("Content-Type", stored.MediaType)
+	w.Header().Set("Docker-Content-Digest", stored.Digest)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifestBytes)))
+	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", stored.Digest))
+	w.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
+	w.WriteHeader(fsthttp.StatusOK)
+	w.Close()
+	// HEAD - no body
+	return nil
+}
+
+// loadManifestForRequest resolves a tag or digest reference to its stored manifest,
+// applying the ?platform= extension query if present
+func loadManifestForRequest(name, reference, query string) (*StoredManifest, []byte, error) {
 	// Resolve tag to digest if needed
 	digest := reference
 	if !strings.HasPrefix(reference, "sha256:") {
 		resolved, err := resolveTag(name, reference)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
 		digest = resolved
 	}
 
-	key := fmt.Sprintf("manifests/%s/%s", name, digest)
-	entry, err := store.Lookup(key)
+	stored, manifestBytes, err := loadStoredManifest(name, digest)
 	if err != nil {
-		return &OCIError{Code: "MANIFEST_UNKNOWN", Message: "manifest unknown", Detail: reference, Status: fsthttp.StatusNotFound}
+		if ociErr, ok := err.(*OCIError); ok && ociErr.Code == "MANIFEST_UNKNOWN" {
+			ociErr.Detail = reference
+		}
+		return nil, nil, err
+	}
+
+	// Resolve a platform-specific child manifest from an image index
+	if platform := extractQueryParam(query, "platform"); platform != "" {
+		return resolvePlatformManifest(name, stored, manifestBytes, platform)
+	}
+
+	return stored, manifestBytes, nil
+}
+
+// loadStoredManifest loads and decodes a manifest by digest
+func loadStoredManifest(name, digest string) (*StoredManifest, []byte, error) {
+	store, err := kvstore.Open(KVStoreManifests)
+	if err != nil {
+		return nil, nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	entry, err := store.Lookup(fmt.Sprintf("manifests/%s/%s", name, digest))
+	if err != nil {
+		return nil, nil, &OCIError{Code: "MANIFEST_UNKNOWN", Message: "manifest unknown", Detail: digest, Status: fsthttp.StatusNotFound}
 	}
 
 	body, err := io.ReadAll(entry)
 	if err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read error: %v", err), Status: fsthttp.StatusInternalServerError}
+		return nil, nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
 	var stored StoredManifest
 	if err := json.Unmarshal(body, &stored); err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid manifest data: %v", err), Status: fsthttp.StatusInternalServerError}
+		return nil, nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid manifest data: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	// Decode to get actual size
 	manifestBytes, err := base64.StdEncoding.DecodeString(stored.Content)
 	if err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Base64 decode error: %v", err), Status: fsthttp.StatusInternalServerError}
+		return nil, nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Base64 decode error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	// Use manual framing mode to preserve Content-Length on HEAD response
-	w.SetManualFramingMode(true)
-	w.Header().Set("Content-Type", stored.MediaType)
-	w.Header().Set("Docker-Content-Digest", stored.Digest)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(manifestBytes)))
-	w.Header().Set("ETag", fmt.Sprintf("\"%s\"", stored.Digest))
-	w.Header().Set("Cache-Control", "max-age=0, private, must-revalidate")
-	w.WriteHeader(fsthttp.StatusOK)
-	w.Close()
-	// HEAD - no body
-	return nil
+	return &stored, manifestBytes, nil
 }
 
-func handlePutManifest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, name, reference string) error {
+func handlePutManifest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, name, reference, account string) error {
 	contentType := r.Header.Get("Content-Type")
 	if contentType == "" {
 		contentType = "application/vnd.docker.distribution.manifest.v2+json"
@@ -163,6 +160,13 @@ func handlePutManifest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp
 		return err
 	}
 
+	// Reject moving tags protected by the tag immutability policy
+	if !strings.HasPrefix(reference, "sha256:") {
+		if err := checkTagMutable(name, reference, digest); err != nil {
+			return err
+		}
+	}
+
 	// Verify referenced blobs exist (optional, can fail silently for performance)
 	if err := VerifyBlobsExist(ctx, manifest); err != nil {
 		fmt.Printf("Warning: blob verification failed: %v\n", err)
@@ -194,7 +198,7 @@ func handlePutManifest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp
 
 	// Save tag if not a digest reference
 	if !strings.HasPrefix(reference, "sha256:") {
-		if err := saveTag(name, reference, digest); err != nil {
+		if err := saveTag(name, reference, digest, account, TagActionPush); err != nil {
 			return err
 		}
 	}
@@ -205,10 +209,21 @@ func handlePutManifest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp
 	}
 
 	// Handle referrers - if manifest has a subject, save the referrer relationship
+	subjectRecorded := false
 	if manifest.Subject != nil && manifest.Subject.Digest != "" {
 		if err := saveReferrer(name, manifest.Subject.Digest, manifest, digest, int64(len(body)), contentType); err != nil {
+			// Don't fail the request: without OCI-Subject the client falls
+			// back to the referrers tag schema
 			fmt.Printf("Warning: failed to save referrer: %v\n", err)
-			// Don't fail the request, just warn
+		} else {
+			subjectRecorded = true
+		}
+	}
+
+	// Index pushed to a referrers fallback tag by a client that doesn't use the referrers API
+	if isImageIndex(contentType) {
+		if err := importReferrersTag(name, reference, manifest); err != nil {
+			fmt.Printf("Warning: failed to import referrers tag: %v\n", err)
 		}
 	}
 
@@ -217,7 +232,10 @@ func handlePutManifest(ctx context.Context, w fsthttp.ResponseWriter, r *fsthttp
 	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, digest))
 	w.Header().Set("Docker-Content-Digest", digest)
 	w.Header().Set("Content-Length", "0")
-	w.Header().Set("OCI-Subject", "") // Signal referrers API support
+	if subjectRecorded {
+		// Tells clients the referrers API recorded the subject (no fallback tag needed)
+		w.Header().Set("OCI-Subject", manifest.Subject.Digest)
+	}
 	w.WriteHeader(fsthttp.StatusCreated)
 	return nil
 }
@@ -236,6 +254,23 @@ func handleDeleteManifest(_ context.Context, w fsthttp.ResponseWriter, name, ref
 			return err
 		}
 		digest = resolved
+
+		// Deleting through an immutable tag would leave it dangling
+		policy, err := loadTagPolicy()
+		if err != nil {
+			return err
+		}
+		if pattern := policy.ImmutablePattern(name, reference); pattern != "" {
+			return tagImmutableError(name, reference, pattern)
+		}
+	} else if err := checkDigestDeletable(name, digest); err != nil {
+		// Deleting by digest must not orphan an immutable tag either
+		return err
+	}
+
+	_, manifestBytes, err := loadStoredManifest(name, digest)
+	if err != nil {
+		return err
 	}
 
 	key := fmt.Sprintf("manifests/%s/%s", name, digest)
@@ -243,6 +278,10 @@ func handleDeleteManifest(_ context.Context, w fsthttp.ResponseWriter, name, ref
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV delete error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
+	if err := deleteReferrer(name, manifestBytes, digest); err != nil {
+		fmt.Printf("Warning: failed to remove referrer: %v\n", err)
+	}
+
 	w.WriteHeader(fsthttp.StatusAccepted)
 	return nil
 }
@@ -267,12 +306,23 @@ func resolveTag(name, tag string) (string, error) {
 	return string(digest), nil
 }
 
-func saveTag(name, tag, digest string) error {
+// saveTag points a tag at a digest and records the movement in the tag history
+func saveTag(name, tag, digest, account, action string) error {
 	store, err := kvstore.Open(KVStoreMetadata)
 	if err != nil {
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
+	previous, _ := resolveTag(name, tag)
+
+	// Record the movement first: a tag must not move without an audit entry
+	if previous != digest {
+		record := TagHistoryEntry{Digest: digest, Previous: previous, Action: action, Account: account}
+		if err := appendTagHistory(name, tag, record); err != nil {
+			return err
+		}
+	}
+
 	key := fmt.Sprintf("tags/%s/%s", name, tag)
 	if err := store.Insert(key, strings.NewReader(digest)); err != nil {
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
@@ -282,64 +332,43 @@ func saveTag(name, tag, digest string) error {
 	return updateTagsList(name, tag)
 }
 
+// updateTagsList adds a tag to the repository's tag index
 func updateTagsList(name, newTag string) error {
 	store, err := kvstore.Open(KVStoreMetadata)
 	if err != nil {
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	key := fmt.Sprintf("taglist/%s", name)
-
-	var tags []string
-	entry, err := store.Lookup(key)
-	if err == nil {
-		body, _ := io.ReadAll(entry)
-		json.Unmarshal(body, &tags)
-	}
-
-	// Check if tag already exists
-	for _, t := range tags {
-		if t == newTag {
-			return nil
-		}
-	}
-
-	tags = append(tags, newTag)
-	value, _ := json.Marshal(tags)
-	if err := store.Insert(key, strings.NewReader(string(value))); err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
-	}
-
-	return nil
+	return tagIndex(store, name).Add(newTag)
 }
 
+// addToCatalog adds a repository to the catalog index on its first push,
+// creating its record. Existing repositories and their records are left alone.
 func addToCatalog(name string) error {
 	store, err := kvstore.Open(KVStoreMetadata)
 	if err != nil {
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	var repos []string
-	entry, err := store.Lookup("catalog")
-	if err == nil {
-		body, _ := io.ReadAll(entry)
-		json.Unmarshal(body, &repos)
+	index := catalogIndex(store)
+	exists, err := index.Contains(name)
+	if err != nil {
+		return err
 	}
-
-	// Check if repo already exists
-	for _, r := range repos {
-		if r == name {
-			return nil
-		}
+	if exists {
+		return nil
 	}
 
-	repos = append(repos, name)
-	value, _ := json.Marshal(repos)
-	if err := store.Insert("catalog", strings.NewReader(string(value))); err != nil {
-		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
+	key := repositoryKey(name)
+	if _, err := store.Lookup(key); errors.Is(err, kvstore.ErrKeyNotFound) {
+		record := RepositoryRecord{Name: name, CreatedAt: time.Now().UTC().Format(time.RFC3339)}
+		value, _ := json.Marshal(record)
+		if err := store.Insert(key, strings.NewReader(string(value))); err != nil {
+			return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
 	}
 
-	return nil
+	return index.Add(name)
 }
 
 func handleListTags(_ context.Context, w fsthttp.ResponseWriter, name string, query string) error {
@@ -348,13 +377,9 @@ func handleListTags(_ context.Context, w fsthttp.ResponseWriter, name string, qu
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	key := fmt.Sprintf("taglist/%s", name)
-
-	var tags []string
-	entry, err := store.Lookup(key)
-	if err == nil {
-		body, _ := io.ReadAll(entry)
-		json.Unmarshal(body, &tags)
+	tags, err := tagIndex(store, name).List()
+	if err != nil {
+		return err
 	}
 
 	// Apply pagination
@@ -383,11 +408,9 @@ func handleCatalog(_ context.Context, w fsthttp.ResponseWriter, query string) er
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	var repos []string
-	entry, err := store.Lookup("catalog")
-	if err == nil {
-		body, _ := io.ReadAll(entry)
-		json.Unmarshal(body, &repos)
+	repos, err := catalogIndex(store).List()
+	if err != nil {
+		return err
 	}
 
 	// Apply pagination
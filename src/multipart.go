@@ -227,44 +227,6 @@ func SignCompleteMultipartUpload(key, uploadId string, body []byte) (*fsthttp.Re
 	return req, nil
 }
 
-// SignPresignedPutURL generates a pre-signed URL for direct S3 upload
-// This allows clients to upload directly to S3, bypassing Fastly's limits
-func SignPresignedPutURL(key string, expiresInSeconds int) (string, error) {
-	accessKey, secretKey, err := loadCredentials()
-	if err != nil {
-		return "", fmt.Errorf("failed to load credentials: %w", err)
-	}
-
-	now := time.Now().UTC()
-	date := now.Format("20060102")
-	datetime := now.Format("20060102T150405Z")
-
-	uri := fmt.Sprintf("/%s/%s", S3Bucket, key)
-
-	// Query parameters for presigned URL
-	queryParams := fmt.Sprintf("X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=%s%%2F%s%%2F%s%%2Fs3%%2Faws4_request&X-Amz-Date=%s&X-Amz-Expires=%d&X-Amz-SignedHeaders=host",
-		accessKey, date, FastlyOSRegion, datetime, expiresInSeconds)
-
-	canonicalHeaders := fmt.Sprintf("host:%s\n", FastlyOSHost)
-	signedHeaders := "host"
-
-	canonicalRequest := fmt.Sprintf("PUT\n%s\n%s\n%s\n%s\nUNSIGNED-PAYLOAD",
-		uri, queryParams, canonicalHeaders, signedHeaders)
-
-	canonicalHash := sha256Hex([]byte(canonicalRequest))
-
-	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, FastlyOSRegion, S3Service)
-	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s",
-		datetime, scope, canonicalHash)
-
-	signature := calculateSignature(secretKey, date, stringToSign)
-
-	presignedURL := fmt.Sprintf("https://%s%s?%s&X-Amz-Signature=%s",
-		FastlyOSHost, uri, queryParams, signature)
-
-	return presignedURL, nil
-}
-
 // ListPartsResult is the XML response from S3 ListParts
 type ListPartsResult struct {
 	XMLName              xml.Name         `xml:"ListPartsResult"`
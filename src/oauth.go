@@ -0,0 +1,122 @@
+// OAuth2 Token Endpoint
+//
+// Implements the Docker registry OAuth2 token flow on POST /token (and
+// POST /v2/auth), used by docker and containerd credential helpers:
+//
+//	grant_type=password       username, password or access token [, access_type=offline]
+//	grant_type=refresh_token  refresh_token
+//	grant_type=urn:ietf:params:oauth:grant-type:token-exchange  subject_token (OIDC JWT)
+//	grant_type=urn:ietf:params:oauth:grant-type:jwt-bearer      assertion (OIDC JWT)
+//
+// With access_type=offline a long-lived refresh token is returned alongside
+// the access token, so clients can store it instead of the password. Refresh
+// tokens are signed like access tokens but carry token_use=refresh and no
+// access claims; they are only accepted here, never as registry credentials.
+// Each refresh re-checks that the account still exists and is enabled, and
+// re-evaluates the access policy for the requested scopes.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+)
+
+const (
+	// Maximum size of a token request form
+	MaxTokenRequestSize = 64 * 1024
+
+	// OAuth2 grant types
+	GrantTypePassword     = "password"
+	GrantTypeRefreshToken = "refresh_token"
+)
+
+// handleOAuthTokenRequest handles POST /token
+func handleOAuthTokenRequest(w fsthttp.ResponseWriter, r *fsthttp.Request) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxTokenRequestSize))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: "invalid token request form", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+	}
+
+	service, err := resolveTokenService(r, form.Get("service"))
+	if err != nil {
+		return err
+	}
+	clientID := form.Get("client_id")
+	ip := getClientIP(r)
+
+	var auth *AuthResult
+	withRefresh := false
+
+	switch form.Get("grant_type") {
+	case GrantTypePassword:
+		username := form.Get("username")
+		var retryAfter int
+		auth, retryAfter = authenticateLogin(username, form.Get("password"), ip)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+			return lockedOutError(retryAfter)
+		}
+		if auth == nil {
+			LogSecurityEvent("AUTH_FAIL", ip, fmt.Sprintf("path=%s grant=password user=%s client=%s", r.URL.Path, username, clientID))
+			return &OCIError{Code: "UNAUTHORIZED", Message: "invalid username or password", Status: fsthttp.StatusUnauthorized}
+		}
+		// Access tokens and federated identities never yield refresh tokens
+		withRefresh = form.Get("access_type") == "offline" && auth.TokenID == "" && !auth.Federated
+
+	case GrantTypeRefreshToken:
+		claims, err := ValidateBearerToken(r, form.Get("refresh_token"))
+		if err == nil && claims.TokenUse != TokenUseRefresh {
+			err = fmt.Errorf("not a refresh token")
+		}
+		if err != nil {
+			LogSecurityEvent("AUTH_FAIL", ip, fmt.Sprintf("path=%s grant=refresh_token client=%s error=%s", r.URL.Path, clientID, err.Error()))
+			return &OCIError{Code: "UNAUTHORIZED", Message: fmt.Sprintf("invalid refresh token: %s", err.Error()), Status: fsthttp.StatusUnauthorized}
+		}
+
+		account, ok := lookupAccount(claims.Subject)
+		if !ok {
+			LogSecurityEvent("AUTH_FAIL", ip, fmt.Sprintf("path=%s grant=refresh_token user=%s error=account unavailable", r.URL.Path, claims.Subject))
+			return &OCIError{Code: "UNAUTHORIZED", Message: "account is disabled or no longer exists", Status: fsthttp.StatusUnauthorized}
+		}
+		auth = &AuthResult{Authenticated: true, Username: claims.Subject, Groups: account.Groups}
+
+	case GrantTypeTokenExchange, GrantTypeJWTBearer:
+		assertion := form.Get("assertion")
+		if form.Get("grant_type") == GrantTypeTokenExchange {
+			assertion = form.Get("subject_token")
+			if tokenType := form.Get("subject_token_type"); tokenType != "" && tokenType != TokenTypeJWT && tokenType != TokenTypeIDToken {
+				return &OCIError{Code: "UNSUPPORTED", Message: "unsupported subject_token_type, expected a JWT", Detail: tokenType, Status: fsthttp.StatusBadRequest}
+			}
+		}
+
+		auth, err = authenticateOIDC(assertion)
+		if err != nil {
+			LogSecurityEvent("AUTH_FAIL", ip, fmt.Sprintf("path=%s grant=%s client=%s error=%s", r.URL.Path, form.Get("grant_type"), clientID, err.Error()))
+			return &OCIError{Code: "UNAUTHORIZED", Message: fmt.Sprintf("invalid OIDC token: %s", err.Error()), Status: fsthttp.StatusUnauthorized}
+		}
+		LogSecurityEvent("OIDC_FEDERATED", ip, fmt.Sprintf("subject=%s scopes=%s client=%s", auth.Username, formatScopes(auth.Limits), clientID))
+
+		// Without an explicit scope, issue everything the rules grant
+		if len(form["scope"]) == 0 {
+			return writeTokenResponse(w, r, auth, service, auth.Limits, false)
+		}
+
+	default:
+		return &OCIError{
+			Code:    "UNSUPPORTED",
+			Message: "unsupported grant_type, expected password, refresh_token, token-exchange or jwt-bearer",
+			Detail:  form.Get("grant_type"),
+			Status:  fsthttp.StatusBadRequest,
+		}
+	}
+
+	return writeTokenResponse(w, r, auth, service, parseScopes(form["scope"]), withRefresh)
+}
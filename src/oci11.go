@@ -1,7 +1,8 @@
 // OCI Distribution Spec 1.1 Features
 //
 // Implements:
-// - Referrers API (GET /v2/<name>/referrers/<digest>)
+// - Referrers API (GET /v2/<name>/referrers/<digest>) with Link pagination
+// - Referrers tag schema fallback (sha256-<hex> index tags)
 // - Extension API Discovery (GET /v2/)
 // - Subject/ArtifactType handling
 
@@ -9,15 +10,34 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fastly/compute-sdk-go/fsthttp"
 	"github.com/fastly/compute-sdk-go/kvstore"
 )
 
+const (
+	// Media type of referrers responses and fallback tag indexes
+	ReferrersIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+	// Account recorded in tag history for tags the registry maintains itself
+	RegistryAccount = "registry"
+)
+
+// referrersTagPattern matches referrers tag schema fallback tags (sha256-<hex>)
+var referrersTagPattern = regexp.MustCompile(`^sha256-[a-f0-9]{64}$`)
+
 // ReferrersList is the response for the referrers API
 type ReferrersList struct {
 	SchemaVersion int             `json:"schemaVersion"`
@@ -46,13 +66,9 @@ func handleReferrers(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Req
 		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
 	}
 
-	key := fmt.Sprintf("referrers/%s/%s", name, digest)
-	var referrers []OCIDescriptor
-
-	entry, err := store.Lookup(key)
-	if err == nil {
-		body, _ := io.ReadAll(entry)
-		json.Unmarshal(body, &referrers)
+	referrers, err := loadReferrers(store, name, digest)
+	if err != nil {
+		return err
 	}
 
 	// Filter by artifactType if specified
@@ -66,41 +82,65 @@ func handleReferrers(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Req
 		referrers = filtered
 	}
 
+	// Page by digest: referrers are sorted lexically and "last" is a cursor
+	n, last := ParsePaginationParams(r.URL.RawQuery)
+	sort.Slice(referrers, func(i, j int) bool { return referrers[i].Digest < referrers[j].Digest })
+	start := 0
+	if last != "" {
+		start = sort.Search(len(referrers), func(i int) bool { return referrers[i].Digest > last })
+	}
+	end := start + n
+	if end > len(referrers) {
+		end = len(referrers)
+	}
+	page := referrers[start:end]
+
+	if end < len(referrers) && len(page) > 0 {
+		query := url.Values{}
+		query.Set("n", strconv.Itoa(n))
+		query.Set("last", page[len(page)-1].Digest)
+		if artifactTypeFilter != "" {
+			query.Set("artifactType", artifactTypeFilter)
+		}
+		linkURL := fmt.Sprintf("/v2/%s/referrers/%s?%s", name, digest, query.Encode())
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, linkURL))
+	}
+
 	// Build response
 	response := ReferrersList{
 		SchemaVersion: 2,
-		MediaType:     "application/vnd.oci.image.index.v1+json",
-		Manifests:     referrers,
+		MediaType:     ReferrersIndexMediaType,
+		Manifests:     page,
 	}
 
 	if response.Manifests == nil {
 		response.Manifests = []OCIDescriptor{}
 	}
 
-	w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
-	w.Header().Set("OCI-Filters-Applied", "artifactType")
+	w.Header().Set("Content-Type", ReferrersIndexMediaType)
+	if artifactTypeFilter != "" {
+		w.Header().Set("OCI-Filters-Applied", "artifactType")
+	}
 	w.WriteHeader(fsthttp.StatusOK)
 	json.NewEncoder(w).Encode(response)
 	return nil
 }
 
-// saveReferrer stores a referrer relationship when a manifest with subject is pushed
-func saveReferrer(name string, subjectDigest string, manifest *OCIManifest, manifestDigest string, manifestSize int64, mediaType string) error {
-	store, err := kvstore.Open(KVStoreMetadata)
-	if err != nil {
-		return fmt.Errorf("KV store error: %w", err)
-	}
-
-	key := fmt.Sprintf("referrers/%s/%s", name, subjectDigest)
-
-	// Load existing referrers
+// loadReferrers loads the stored referrer descriptors for a subject digest
+func loadReferrers(store *kvstore.Store, name, subjectDigest string) ([]OCIDescriptor, error) {
 	var referrers []OCIDescriptor
-	entry, err := store.Lookup(key)
+	entry, err := store.Lookup(fmt.Sprintf("referrers/%s/%s", name, subjectDigest))
 	if err == nil {
 		body, _ := io.ReadAll(entry)
-		json.Unmarshal(body, &referrers)
+		if err := json.Unmarshal(body, &referrers); err != nil {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid referrers data: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
 	}
+	return referrers, nil
+}
 
+// saveReferrer stores a referrer relationship when a manifest with subject is pushed
+func saveReferrer(name string, subjectDigest string, manifest *OCIManifest, manifestDigest string, manifestSize int64, mediaType string) error {
 	// Determine artifact type
 	artifactType := manifest.ArtifactType
 	if artifactType == "" && manifest.Config != nil {
@@ -116,45 +156,351 @@ func saveReferrer(name string, subjectDigest string, manifest *OCIManifest, mani
 		Annotations:  manifest.Annotations,
 	}
 
-	// Check if already exists and update
-	found := false
-	for i, ref := range referrers {
-		if ref.Digest == manifestDigest {
-			referrers[i] = newReferrer
-			found = true
-			break
+	if err := addReferrers(name, subjectDigest, []OCIDescriptor{newReferrer}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Saved referrer: %s -> %s (artifactType: %s)\n", manifestDigest, subjectDigest, artifactType)
+	return nil
+}
+
+// addReferrers upserts referrer descriptors for a subject and refreshes its fallback tag
+func addReferrers(name, subjectDigest string, descriptors []OCIDescriptor) error {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return fmt.Errorf("KV store error: %w", err)
+	}
+
+	// Load existing referrers
+	referrers, err := loadReferrers(store, name, subjectDigest)
+	if err != nil {
+		return err
+	}
+
+	// Update existing entries in place, append new ones
+	for _, desc := range descriptors {
+		found := false
+		for i, ref := range referrers {
+			if ref.Digest == desc.Digest {
+				referrers[i] = desc
+				found = true
+				break
+			}
+		}
+		if !found {
+			referrers = append(referrers, desc)
+		}
+	}
+
+	return saveReferrers(store, name, subjectDigest, referrers)
+}
+
+// removeReferrer drops a deleted manifest from its subject's referrers and
+// refreshes the fallback tag
+func removeReferrer(name, subjectDigest, manifestDigest string) error {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return fmt.Errorf("KV store error: %w", err)
+	}
+
+	referrers, err := loadReferrers(store, name, subjectDigest)
+	if err != nil {
+		return err
+	}
+
+	kept := referrers[:0]
+	for _, ref := range referrers {
+		if ref.Digest != manifestDigest {
+			kept = append(kept, ref)
 		}
 	}
-	if !found {
-		referrers = append(referrers, newReferrer)
+	if len(kept) == len(referrers) {
+		return nil
 	}
 
-	// Save back
+	return saveReferrers(store, name, subjectDigest, kept)
+}
+
+// saveReferrers stores a subject's referrers and refreshes its fallback tag
+func saveReferrers(store *kvstore.Store, name, subjectDigest string, referrers []OCIDescriptor) error {
+	if referrers == nil {
+		referrers = []OCIDescriptor{}
+	}
 	value, _ := json.Marshal(referrers)
-	if err := store.Insert(key, strings.NewReader(string(value))); err != nil {
+	if err := store.Insert(fmt.Sprintf("referrers/%s/%s", name, subjectDigest), strings.NewReader(string(value))); err != nil {
 		return fmt.Errorf("KV insert error: %w", err)
 	}
 
-	fmt.Printf("Saved referrer: %s -> %s (artifactType: %s)\n", manifestDigest, subjectDigest, artifactType)
-	return nil
+	return syncReferrersTag(name, subjectDigest, referrers)
 }
 
-// deleteReferrer removes a referrer when a manifest is deleted
-func deleteReferrer(name string, manifestDigest string) error {
-	// This would require tracking which subject a manifest refers to
-	// For now, we skip this as it's complex and optional
+// referrersTag returns the tag schema fallback tag for a subject digest
+func referrersTag(subjectDigest string) string {
+	return strings.Replace(subjectDigest, ":", "-", 1)
+}
+
+// referrersTagOwnerKey records the digest the registry last wrote to a
+// subject's fallback tag (in the metadata store)
+func referrersTagOwnerKey(name, subjectDigest string) string {
+	return fmt.Sprintf("referrerstag/%s/%s", name, subjectDigest)
+}
+
+// syncReferrersTag maintains the OCI 1.1 referrers tag schema fallback: an image
+// index listing every referrer, tagged sha256-<hex>, for clients that don't use
+// the referrers API. A tag a client pushed itself is left alone, and the tag
+// policy applies to the registry's writes like any other push.
+func syncReferrersTag(name, subjectDigest string, referrers []OCIDescriptor) error {
+	tag := referrersTag(subjectDigest)
+
+	meta, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return fmt.Errorf("KV store error: %w", err)
+	}
+	if current, err := resolveTag(name, tag); err == nil {
+		owned := ""
+		if entry, err := meta.Lookup(referrersTagOwnerKey(name, subjectDigest)); err == nil {
+			body, _ := io.ReadAll(entry)
+			owned = string(body)
+		}
+		if current != owned {
+			return nil
+		}
+	}
+
+	sorted := make([]OCIDescriptor, len(referrers))
+	copy(sorted, referrers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Digest < sorted[j].Digest })
+
+	index := ReferrersList{
+		SchemaVersion: 2,
+		MediaType:     ReferrersIndexMediaType,
+		Manifests:     sorted,
+	}
+	body, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("JSON error: %w", err)
+	}
+
+	hash := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+
+	store, err := kvstore.Open(KVStoreManifests)
+	if err != nil {
+		return fmt.Errorf("KV store error: %w", err)
+	}
+
+	stored := StoredManifest{
+		Digest:    digest,
+		MediaType: ReferrersIndexMediaType,
+		Size:      int64(len(body)),
+		Content:   base64.StdEncoding.EncodeToString(body),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	value, _ := json.Marshal(stored)
+	if err := store.Insert(fmt.Sprintf("manifests/%s/%s", name, digest), strings.NewReader(string(value))); err != nil {
+		return fmt.Errorf("KV insert error: %w", err)
+	}
+
+	if err := checkTagMutable(name, tag, digest); err != nil {
+		return err
+	}
+	if err := saveTag(name, tag, digest, RegistryAccount, TagActionPush); err != nil {
+		return err
+	}
+	if err := meta.Insert(referrersTagOwnerKey(name, subjectDigest), strings.NewReader(digest)); err != nil {
+		return fmt.Errorf("KV insert error: %w", err)
+	}
 	return nil
 }
 
-// ExtensionDiscovery response for GET /v2/
+// importReferrersTag records the entries of an index pushed by a tag-schema
+// client to a sha256-<hex> tag, so the referrers API sees them too
+func importReferrersTag(name, tag string, manifest *OCIManifest) error {
+	if !referrersTagPattern.MatchString(tag) || len(manifest.Manifests) == 0 {
+		return nil
+	}
+	subjectDigest := strings.Replace(tag, "-", ":", 1)
+	return addReferrers(name, subjectDigest, manifest.Manifests)
+}
+
+// deleteReferrer removes a manifest being deleted from the referrers of its
+// subject, if it has one
+func deleteReferrer(name string, manifestBytes []byte, manifestDigest string) error {
+	var manifest OCIManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil || manifest.Subject == nil || manifest.Subject.Digest == "" {
+		return nil
+	}
+	return removeReferrer(name, manifest.Subject.Digest, manifestDigest)
+}
+
+const (
+	// OCI extension discovery endpoint (relative to /v2/ or /v2/<name>/)
+	OCIDiscoverEndpoint = "_oci/ext/discover"
+
+	OCIExtensionsSpecURL = "https://github.com/opencontainers/distribution-spec/blob/main/extensions/_oci.md"
+	EdgeOCIExtensionsURL = "https://github.com/Aerosane/edgeoci/blob/main/docs/API_REFERENCE.md#registry-extensions"
+)
+
+// ExtensionDiscovery response for GET /v2/_oci/ext/discover and /v2/<name>/_oci/ext/discover
 type ExtensionDiscovery struct {
-	// Empty for basic compliance, extensions would be listed here
+	Extensions   []ExtensionInfo        `json:"extensions"`
+	Capabilities map[string]interface{} `json:"capabilities,omitempty"`
+}
+
+// ExtensionInfo describes a single extension per the OCI extensions spec
+type ExtensionInfo struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Description string   `json:"description,omitempty"`
+	Endpoints   []string `json:"endpoints"`
+}
+
+// handleExtensionDiscovery handles GET /v2/_oci/ext/discover (registry level, name = "")
+// and GET /v2/<name>/_oci/ext/discover (repository level)
+func handleExtensionDiscovery(_ context.Context, w fsthttp.ResponseWriter, name string) error {
+	response := ExtensionDiscovery{
+		Extensions:   registryExtensions(name),
+		Capabilities: getRegistryCapabilities(),
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	return nil
 }
 
-// getRegistryCapabilities returns the registry's capabilities for API version response
+// extensionRoute describes a group of extension endpoints for discovery.
+// Endpoints are relative to /v2/ (registry level) or /v2/<name>/ (repository
+// level); add them here together with their route.
+type extensionRoute struct {
+	Name        string
+	Description string
+	Repository  bool
+	Endpoints   []string
+}
+
+// extensionRoutes lists the registry's extensions
+var extensionRoutes = []extensionRoute{
+	{
+		Name:        ExtensionNamespace + "/catalog",
+		Description: "Catalog with repository metadata and search",
+		Endpoints:   []string{ExtensionNamespace + "/catalog"},
+	},
+	{
+		Name:        ExtensionNamespace + "/users",
+		Description: "User account administration",
+		Endpoints: []string{
+			ExtensionNamespace + "/users",
+			ExtensionNamespace + "/users/<name>",
+			ExtensionNamespace + "/users/<name>/password",
+			ExtensionNamespace + "/users/<name>/unlock",
+		},
+	},
+	{
+		Name:        ExtensionNamespace + "/tokens",
+		Description: "Personal access tokens",
+		Endpoints: []string{
+			ExtensionNamespace + "/tokens",
+			ExtensionNamespace + "/tokens/<id>",
+		},
+	},
+	{
+		Name:        ExtensionNamespace + "/revocations",
+		Description: "Bearer token revocation",
+		Endpoints:   []string{ExtensionNamespace + "/revocations"},
+	},
+	{
+		Name:        ExtensionNamespace + "/tags",
+		Description: "Tag history and rollback",
+		Repository:  true,
+		Endpoints: []string{
+			ExtensionNamespace + "/tags/<tag>/history",
+			ExtensionNamespace + "/tags/<tag>/rollback",
+		},
+	},
+	{
+		Name:        ExtensionNamespace + "/metadata",
+		Description: "Repository description, README, owner and labels",
+		Repository:  true,
+		Endpoints:   []string{ExtensionNamespace + "/metadata"},
+	},
+}
+
+// registryExtensions lists the extensions available at registry level (name = "")
+// or for a repository
+func registryExtensions(name string) []ExtensionInfo {
+	extensions := []ExtensionInfo{
+		{
+			Name:        "_oci",
+			URL:         OCIExtensionsSpecURL,
+			Description: "OCI extension discovery",
+			Endpoints:   []string{OCIDiscoverEndpoint},
+		},
+	}
+
+	for _, ext := range extensionRoutes {
+		if ext.Repository != (name != "") {
+			continue
+		}
+		extensions = append(extensions, ExtensionInfo{
+			Name:        ext.Name,
+			URL:         EdgeOCIExtensionsURL,
+			Description: ext.Description,
+			Endpoints:   ext.Endpoints,
+		})
+	}
+	return extensions
+}
+
+// getRegistryCapabilities reports which optional features are enabled in the
+// running configuration, so clients can feature-detect instead of hard-coding
 func getRegistryCapabilities() map[string]interface{} {
+	tagImmutability := false
+	if policy, err := loadTagPolicy(); err == nil {
+		tagImmutability = len(policy.Rules) > 0
+	}
+	oidcFederation := false
+	if config, err := loadOIDCConfig(); err == nil && config != nil {
+		oidcFederation = AuthEnabled && len(config.Issuers) > 0
+	}
+
+	// Budgets in requests per rate_limit_window, after defaults
+	config := loadRateLimitConfig()
+	rateLimits := map[string]RateLimitTier{
+		"anonymous": config.Anonymous.withDefaults(defaultRateLimits.Anonymous),
+		"account":   config.Account.withDefaults(defaultRateLimits.Account),
+		"robot":     config.Robot.withDefaults(defaultRateLimits.Robot),
+	}
+	jwksURI := ""
+	if AuthEnabled {
+		jwksURI = JWKSPath
+	}
+
 	return map[string]interface{}{
-		// Basic OCI Distribution compliance
-		// Extensions could be added here
+		"referrers":              true,
+		"referrers_tag_fallback": true,
+		"referrers_pagination":   true,
+		"cross_repo_mount":       true,
+		"chunked_upload":         true,
+		"resumable_upload":       true,
+		"range_get":              false,
+		"platform_resolution":    true,
+		"tag_history":            true,
+		"tag_rollback":           true,
+		"tag_immutability":       tagImmutability,
+		"repository_metadata":    true,
+		"search":                 true,
+		"authentication":         AuthEnabled,
+		"user_accounts":          AuthEnabled,
+		"access_tokens":          AuthEnabled,
+		"oidc_federation":        oidcFederation,
+		"token_revocation":       AuthEnabled,
+		"login_lockout":          AuthEnabled,
+		"jwks_uri":               jwksURI,
+		"rate_limit":             RateLimitEnabled,
+		"rate_limit_window":      RateLimitWindow,
+		"rate_limit_ip_ceiling":  RateLimitIPCeiling,
+		"rate_limit_tiers":       rateLimits,
+		"max_manifest_size":      MaxManifestSize,
 	}
 }
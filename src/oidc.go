@@ -0,0 +1,507 @@
+// OIDC Workload Identity Federation
+//
+// Lets CI jobs (GitHub Actions, GitLab CI, ...) push without stored secrets.
+// A job presents the OIDC JWT its platform issued; the registry verifies it
+// against the configured issuer's JWKS, maps its claims to registry scopes
+// through rules, and issues a short-lived registry token.
+//
+// Issuers and rules live in the metadata KV store under "config/oidc". JWKS
+// documents are fetched over dynamic backends and cached in KV
+// ("oidc/jwks/<issuer hash>") and in memory.
+//
+// The JWT is accepted at the token endpoint:
+//
+//	POST /token  grant_type=urn:ietf:params:oauth:grant-type:token-exchange&subject_token=<jwt>
+//	POST /token  grant_type=urn:ietf:params:oauth:grant-type:jwt-bearer&assertion=<jwt>
+//	GET  /v2/auth with Basic credentials "oidc:<jwt>" (docker login -u oidc)
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// KV key (in the metadata store) holding the federation configuration
+	OIDCConfigKey = "config/oidc"
+
+	// Token endpoint grant and token types (RFC 8693, RFC 7523)
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	GrantTypeJWTBearer     = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+
+	// Basic auth username that marks the password as an OIDC JWT
+	OIDCLoginUsername = "oidc"
+
+	// Lifetime of registry tokens issued for federated identities
+	FederatedTokenExpiry = 600 // 10 minutes in seconds
+
+	// JWKS caching
+	OIDCJWKSCacheTTL        = time.Hour
+	OIDCJWKSRefetchInterval = 5 * time.Minute
+	MaxOIDCDocumentSize     = 1024 * 1024
+
+	// Allowed clock skew when checking exp/nbf/iat
+	OIDCClockLeeway = 60 // seconds
+)
+
+// OIDCConfig is the stored federation configuration
+//
+// Example:
+//
+//	{"issuers":[{
+//	  "name":"github",
+//	  "issuer":"https://token.actions.githubusercontent.com",
+//	  "audience":"registry.aerosane.dev",
+//	  "rules":[
+//	    {"claims":{"repository":"acme/app","ref":"refs/heads/main"},"scopes":["repository:acme/app:pull,push"]},
+//	    {"claims":{"repository_owner":"acme"},"scopes":["repository:acme/base:pull"]}
+//	  ]
+//	}]}
+type OIDCConfig struct {
+	Issuers []OIDCIssuer `json:"issuers"`
+}
+
+// OIDCIssuer is a trusted token issuer and its claim rules
+type OIDCIssuer struct {
+	Name         string     `json:"name"`                    // Short name used in subjects ("oidc:<name>:<sub>")
+	Issuer       string     `json:"issuer"`                  // Must equal the token's iss
+	Audience     string     `json:"audience"`                // Required aud value
+	JWKSURI      string     `json:"jwks_uri,omitempty"`      // Default: discovered from <issuer>/.well-known/openid-configuration
+	JWKS         *JWKSet    `json:"jwks,omitempty"`          // Static keys instead of fetching (tests, air-gapped issuers)
+	SubjectClaim string     `json:"subject_claim,omitempty"` // Claim naming the identity, default "sub"
+	Rules        []OIDCRule `json:"rules"`
+}
+
+// OIDCRule grants scopes when every listed claim matches its glob
+type OIDCRule struct {
+	Claims map[string]string `json:"claims"`
+	Scopes []string          `json:"scopes"`
+}
+
+// cachedJWKS is a fetched key set ("oidc/jwks/<issuer hash>")
+type cachedJWKS struct {
+	FetchedAt int64  `json:"fetched_at"`
+	JWKS      JWKSet `json:"jwks"`
+}
+
+// In-memory JWKS cache per issuer
+var (
+	oidcJWKSCache   = make(map[string]*cachedJWKS)
+	oidcJWKSCacheMu sync.Mutex
+)
+
+// loadOIDCConfig loads the federation configuration (nil if none is configured)
+func loadOIDCConfig() (*OIDCConfig, error) {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("KV store error: %v", err)
+	}
+
+	entry, err := store.Lookup(OIDCConfigKey)
+	if err != nil {
+		return nil, nil
+	}
+
+	body, _ := io.ReadAll(entry)
+	config := &OIDCConfig{}
+	if err := json.Unmarshal(body, config); err != nil {
+		return nil, fmt.Errorf("invalid OIDC configuration: %v", err)
+	}
+	return config, nil
+}
+
+// authenticateOIDC verifies an externally issued JWT and maps it to a
+// federated identity limited to the scopes of the matching rules
+func authenticateOIDC(token string) (*AuthResult, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid token format")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		KID string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid header")
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid claims")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding")
+	}
+
+	config, err := loadOIDCConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("federation is not configured")
+	}
+
+	iss, _ := claims["iss"].(string)
+	var issuer *OIDCIssuer
+	for i := range config.Issuers {
+		if config.Issuers[i].Issuer == iss {
+			issuer = &config.Issuers[i]
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("untrusted issuer %q", iss)
+	}
+	if issuer.Audience == "" {
+		return nil, fmt.Errorf("issuer %q has no audience configured", iss)
+	}
+
+	// Verify the signature, refetching the key set once for an unknown kid
+	key, err := issuerSigningKey(issuer, header.KID, false)
+	if err != nil {
+		key, err = issuerSigningKey(issuer, header.KID, true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !verifyJWTSignature(key, header.Alg, parts[0]+"."+parts[1], signature) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if err := checkOIDCClaims(claims, issuer.Audience); err != nil {
+		return nil, err
+	}
+
+	subjectClaim := issuer.SubjectClaim
+	if subjectClaim == "" {
+		subjectClaim = "sub"
+	}
+	subject := claimString(claims[subjectClaim])
+	if subject == "" {
+		return nil, fmt.Errorf("token has no %s claim", subjectClaim)
+	}
+
+	scopes, err := oidcScopes(issuer, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	name := issuer.Name
+	if name == "" {
+		name = issuer.Issuer
+	}
+	return &AuthResult{
+		Authenticated: true,
+		Username:      fmt.Sprintf("oidc:%s:%s", name, subject),
+		Federated:     true,
+		Limits:        scopes,
+	}, nil
+}
+
+// checkOIDCClaims validates exp, nbf, iat and aud
+func checkOIDCClaims(claims map[string]interface{}, audience string) error {
+	now := time.Now().Unix()
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no exp claim")
+	}
+	if now > int64(exp)+OIDCClockLeeway {
+		return fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now+OIDCClockLeeway < int64(nbf) {
+		return fmt.Errorf("token not yet valid")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now+OIDCClockLeeway < int64(iat) {
+		return fmt.Errorf("token issued in the future")
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("token audience does not include %q", audience)
+}
+
+// oidcScopes collects the scopes of every rule whose claim globs all match
+func oidcScopes(issuer *OIDCIssuer, claims map[string]interface{}) ([]AccessEntry, error) {
+	var scopes []string
+	for _, rule := range issuer.Rules {
+		if len(rule.Claims) == 0 {
+			continue
+		}
+		matched := true
+		for claim, pattern := range rule.Claims {
+			value := claimString(claims[claim])
+			if ok, _ := path.Match(pattern, value); !ok || value == "" {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			scopes = append(scopes, rule.Scopes...)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("no federation rule matches the token")
+	}
+
+	entries, err := parseTokenScopes(scopes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid scope in federation rule: %v", err)
+	}
+	return entries, nil
+}
+
+// claimString renders a scalar claim value as a string
+func claimString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case bool:
+		return fmt.Sprintf("%t", value)
+	case float64:
+		return fmt.Sprintf("%v", value)
+	}
+	return ""
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyJWTSignature checks an RS256/ES256 signature against a JWK
+func verifyJWTSignature(key *JWK, alg, message string, signature []byte) bool {
+	if key.Alg != "" && key.Alg != alg {
+		return false
+	}
+	pub, err := key.PublicKey()
+	if err != nil {
+		return false
+	}
+	digest := sha256.Sum256([]byte(message))
+
+	switch alg {
+	case AlgRS256:
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) == nil
+	case AlgES256:
+		ecKey, ok := pub.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest[:], r, s)
+	}
+	return false
+}
+
+// PublicKey converts a JWK into an RSA or P-256 public key
+func (k *JWK) PublicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < MinRSAKeyBits {
+			return nil, fmt.Errorf("RSA key too small")
+		}
+		return key, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("EC point not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// issuerSigningKey finds the issuer's key for kid (the only key if kid is empty)
+func issuerSigningKey(issuer *OIDCIssuer, kid string, refresh bool) (*JWK, error) {
+	var set *JWKSet
+	if issuer.JWKS != nil {
+		if refresh {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		set = issuer.JWKS
+	} else {
+		fetched, err := issuerJWKS(issuer, refresh)
+		if err != nil {
+			return nil, err
+		}
+		set = fetched
+	}
+
+	for i := range set.Keys {
+		if set.Keys[i].KID == kid || (kid == "" && len(set.Keys) == 1) {
+			return &set.Keys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func oidcJWKSKey(issuer string) string {
+	h := sha256.Sum256([]byte(issuer))
+	return "oidc/jwks/" + hex.EncodeToString(h[:8])
+}
+
+// issuerJWKS returns the issuer's key set from memory, KV or the network.
+// refresh forces a fetch unless one happened within OIDCJWKSRefetchInterval.
+func issuerJWKS(issuer *OIDCIssuer, refresh bool) (*JWKSet, error) {
+	now := time.Now()
+	fresh := func(c *cachedJWKS) bool {
+		age := now.Sub(time.Unix(c.FetchedAt, 0))
+		if refresh {
+			return age < OIDCJWKSRefetchInterval
+		}
+		return age < OIDCJWKSCacheTTL
+	}
+
+	oidcJWKSCacheMu.Lock()
+	cached := oidcJWKSCache[issuer.Issuer]
+	oidcJWKSCacheMu.Unlock()
+	if cached != nil && fresh(cached) {
+		return &cached.JWKS, nil
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("KV store error: %v", err)
+	}
+	cacheKey := oidcJWKSKey(issuer.Issuer)
+
+	if entry, err := store.Lookup(cacheKey); err == nil {
+		body, _ := io.ReadAll(entry)
+		var stored cachedJWKS
+		if json.Unmarshal(body, &stored) == nil && fresh(&stored) {
+			oidcJWKSCacheMu.Lock()
+			oidcJWKSCache[issuer.Issuer] = &stored
+			oidcJWKSCacheMu.Unlock()
+			return &stored.JWKS, nil
+		}
+	}
+
+	jwksURI := issuer.JWKSURI
+	if jwksURI == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := fetchOIDCDocument(strings.TrimSuffix(issuer.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+		}
+		jwksURI = discovery.JWKSURI
+	}
+
+	fetched := &cachedJWKS{FetchedAt: now.Unix()}
+	if err := fetchOIDCDocument(jwksURI, &fetched.JWKS); err != nil {
+		return nil, fmt.Errorf("JWKS fetch failed: %v", err)
+	}
+
+	value, _ := json.Marshal(fetched)
+	store.Insert(cacheKey, strings.NewReader(string(value)))
+
+	oidcJWKSCacheMu.Lock()
+	oidcJWKSCache[issuer.Issuer] = fetched
+	oidcJWKSCacheMu.Unlock()
+
+	fmt.Printf("OIDC: fetched %d key(s) for %s\n", len(fetched.JWKS.Keys), issuer.Issuer)
+	return &fetched.JWKS, nil
+}
+
+// fetchOIDCDocument GETs a JSON document over HTTPS through a dynamic backend
+func fetchOIDCDocument(rawURL string, v interface{}) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid URL %q, https is required", rawURL)
+	}
+
+	backend := "oidc_" + strings.NewReplacer(".", "_", ":", "_", "-", "_").Replace(u.Host)
+	options := fsthttp.NewBackendOptions().
+		UseSSL(true).
+		SNIHostname(u.Hostname()).
+		CertHostname(u.Hostname()).
+		HostOverride(u.Hostname()).
+		ConnectTimeout(5 * time.Second).
+		FirstByteTimeout(10 * time.Second)
+	if _, err := fsthttp.RegisterDynamicBackend(backend, u.Host, options); err != nil && !errors.Is(err, fsthttp.ErrBackendNameInUse) {
+		return err
+	}
+
+	req, err := fsthttp.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", ContentTypeJSON)
+
+	// Token requests carry no context; fetches are bounded by the backend timeouts
+	resp, err := req.Send(context.Background(), backend)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != fsthttp.StatusOK {
+		return fmt.Errorf("%s returned %d", rawURL, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxOIDCDocumentSize))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,132 @@
+// Platform-Aware Manifest Resolution
+//
+// Extension query on manifest GET/HEAD:
+//
+//	GET /v2/<name>/manifests/<reference>?platform=linux/arm64/v8
+//
+// When the reference is an image index, the child manifest matching the
+// requested platform is returned with its own digest headers, so clients
+// don't need to walk the index themselves.
+//
+// Platform format: os[(os.version)]/architecture[/variant], e.g.
+// "linux/amd64", "linux/arm/v7", "windows(10.0.17763.5458)/amd64".
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+)
+
+// parsePlatform parses a platform specifier into an OCIPlatform
+func parsePlatform(spec string) (*OCIPlatform, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, &OCIError{
+			Code:    "UNSUPPORTED",
+			Message: "invalid platform, expected os[(os.version)]/architecture[/variant]",
+			Detail:  spec,
+			Status:  fsthttp.StatusBadRequest,
+		}
+	}
+
+	platform := &OCIPlatform{OS: strings.ToLower(parts[0]), Architecture: strings.ToLower(parts[1])}
+	if open := strings.Index(platform.OS, "("); open != -1 {
+		if !strings.HasSuffix(platform.OS, ")") {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: "invalid platform os.version", Detail: spec, Status: fsthttp.StatusBadRequest}
+		}
+		platform.OSVersion = platform.OS[open+1 : len(platform.OS)-1]
+		platform.OS = platform.OS[:open]
+	}
+	if len(parts) == 3 {
+		platform.Variant = strings.ToLower(parts[2])
+	}
+	return platform, nil
+}
+
+// normalizeVariant fills in the implied default variant for an architecture
+func normalizeVariant(arch, variant string) string {
+	if variant != "" {
+		return variant
+	}
+	switch arch {
+	case "arm64":
+		return "v8"
+	case "arm":
+		return "v7"
+	case "amd64":
+		return "v1"
+	}
+	return ""
+}
+
+// platformMatchScore returns how well candidate matches want (0 = no match)
+func platformMatchScore(want, candidate *OCIPlatform) int {
+	if candidate == nil {
+		return 0
+	}
+	if want.OS != strings.ToLower(candidate.OS) || want.Architecture != strings.ToLower(candidate.Architecture) {
+		return 0
+	}
+	if want.OSVersion != "" && want.OSVersion != candidate.OSVersion {
+		return 0
+	}
+
+	candidateVariant := normalizeVariant(candidate.Architecture, strings.ToLower(candidate.Variant))
+	if want.Variant != "" {
+		if normalizeVariant(want.Architecture, want.Variant) != candidateVariant {
+			return 0
+		}
+		return 2
+	}
+
+	// No variant requested: any variant matches, the architecture's default is preferred
+	if candidateVariant == normalizeVariant(want.Architecture, "") {
+		return 2
+	}
+	return 1
+}
+
+// resolvePlatformManifest returns the child of an image index matching the platform spec
+func resolvePlatformManifest(name string, index *StoredManifest, indexBytes []byte, spec string) (*StoredManifest, []byte, error) {
+	want, err := parsePlatform(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !isImageIndex(index.MediaType) {
+		return nil, nil, &OCIError{
+			Code:    "MANIFEST_UNKNOWN",
+			Message: fmt.Sprintf("no manifest for platform %s", spec),
+			Detail:  "reference is not an image index",
+			Status:  fsthttp.StatusNotFound,
+		}
+	}
+
+	var parsed OCIManifest
+	if err := json.Unmarshal(indexBytes, &parsed); err != nil {
+		return nil, nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid index data: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	var best *OCIDescriptor
+	bestScore := 0
+	for i := range parsed.Manifests {
+		if score := platformMatchScore(want, parsed.Manifests[i].Platform); score > bestScore {
+			best = &parsed.Manifests[i]
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return nil, nil, &OCIError{
+			Code:    "MANIFEST_UNKNOWN",
+			Message: fmt.Sprintf("no manifest for platform %s", spec),
+			Detail:  index.Digest,
+			Status:  fsthttp.StatusNotFound,
+		}
+	}
+
+	return loadStoredManifest(name, best.Digest)
+}
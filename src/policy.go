@@ -0,0 +1,378 @@
+// Access Policy
+//
+// Decides which actions an authenticated caller may be granted on a
+// resource. The token endpoint intersects the requested scopes with these
+// grants and silently drops everything else, as the Docker token
+// specification prescribes: a client asking for more than it may have gets a
+// token carrying only what it is allowed. Basic-authenticated requests are
+// checked against the same grants directly.
+//
+// Grants come from a declarative ACL policy in the metadata KV store under
+// "config/acl-policy". Rules map subjects to repository patterns and actions;
+// a caller's grants are the union of all matching rules. Without rules,
+// every enabled account may use every repository. Administrators (the
+// bootstrap account and the "admin" group) always hold every action.
+//
+// Repositories matching the policy's "public" patterns can be pulled by
+// anyone, including callers without credentials.
+//
+// Registry-wide endpoints use Docker's "registry" resource type:
+// "registry:catalog:*" lists repositories (every account holds it) and
+// "registry:admin:*" manages users and tokens (administrators only). Bearer
+// tokens must carry the matching scope to reach these endpoints.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// KV key (in the metadata store) holding the ACL policy document
+	ACLPolicyKey = "config/acl-policy"
+
+	// Rule subjects: "user:<name>", "group:<name>", or any authenticated account
+	SubjectUserPrefix  = "user:"
+	SubjectGroupPrefix = "group:"
+	SubjectAnyAccount  = "*"
+
+	// Scope resource types
+	ScopeTypeRepository = "repository"
+	ScopeTypeRegistry   = "registry"
+
+	// Registry-level resources ("registry:<name>:*")
+	RegistryCatalog = "catalog"
+	RegistryAdmin   = "admin"
+
+	// Repository actions
+	ActionPull   = "pull"
+	ActionPush   = "push"
+	ActionDelete = "delete"
+	ActionAdmin  = "admin"
+)
+
+// repositoryActions lists every grantable repository action
+var repositoryActions = []string{ActionPull, ActionPush, ActionDelete, ActionAdmin}
+
+// registryActions is the only action on registry-level resources
+var registryActions = []string{"*"}
+
+// ACLPolicy is the stored repository access policy
+//
+// Example:
+//
+//	{"rules":[
+//	  {"subjects":["group:team-a"],"repositories":["team-a/**"],"actions":["pull","push","delete"]},
+//	  {"subjects":["user:deploy"],"repositories":["team-a/*","team-b/*"],"actions":["pull"]},
+//	  {"subjects":["*"],"repositories":["base/**"],"actions":["pull"]}
+//	],
+//	 "public":["public/**"]}
+type ACLPolicy struct {
+	Rules  []ACLRule `json:"rules"`
+	Public []string  `json:"public,omitempty"` // Repository patterns anyone may pull
+}
+
+// ACLRule grants actions on matching repositories to its subjects
+type ACLRule struct {
+	Subjects     []string `json:"subjects"`     // "user:<name>", "group:<name>" or "*"
+	Repositories []string `json:"repositories"` // Repository patterns ("*" = one path segment, "**" = any)
+	Actions      []string `json:"actions"`      // pull, push, delete, admin, or "*"
+}
+
+// loadACLPolicy loads the ACL policy from KV, returning nil if none is configured
+func loadACLPolicy() (*ACLPolicy, error) {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	entry, err := store.Lookup(ACLPolicyKey)
+	if err != nil {
+		return nil, nil
+	}
+
+	body, _ := io.ReadAll(entry)
+	policy := &ACLPolicy{}
+	if err := json.Unmarshal(body, policy); err != nil {
+		return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid ACL policy: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if len(policy.Rules) == 0 && len(policy.Public) == 0 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// IsPublic reports whether anyone may pull a repository
+func (p *ACLPolicy) IsPublic(name string) bool {
+	rule := ACLRule{Repositories: p.Public}
+	return rule.coversRepository(name)
+}
+
+// Actions returns the actions the policy grants an account on a repository
+func (p *ACLPolicy) Actions(username string, groups []string, name string) []string {
+	var granted []string
+	for _, rule := range p.Rules {
+		if !rule.appliesTo(username, groups) || !rule.coversRepository(name) {
+			continue
+		}
+		for _, action := range rule.Actions {
+			if action == "*" {
+				granted = mergeActions(granted, repositoryActions)
+			} else if containsAction(repositoryActions, action) {
+				granted = mergeActions(granted, []string{action})
+			}
+		}
+	}
+	return granted
+}
+
+// appliesTo reports whether the rule names the account or one of its groups
+func (r *ACLRule) appliesTo(username string, groups []string) bool {
+	for _, subject := range r.Subjects {
+		switch {
+		case subject == SubjectAnyAccount:
+			return true
+		case strings.HasPrefix(subject, SubjectUserPrefix):
+			if subject[len(SubjectUserPrefix):] == username {
+				return true
+			}
+		case strings.HasPrefix(subject, SubjectGroupPrefix):
+			for _, g := range groups {
+				if subject[len(SubjectGroupPrefix):] == g {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// coversRepository reports whether the rule's patterns match a repository.
+// The token wildcard name "*" (every repository) is only covered by "**".
+func (r *ACLRule) coversRepository(name string) bool {
+	for _, pattern := range r.Repositories {
+		if pattern == "" {
+			continue
+		}
+		if name == "*" {
+			if pattern == "**" {
+				return true
+			}
+			continue
+		}
+		if matchRepositoryPattern(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// grantedActions returns the actions the caller may be granted on a resource.
+// Callers using a personal access token are further limited to its scopes.
+func grantedActions(auth *AuthResult, resourceType, name string) []string {
+	granted := accountGrantedActions(auth, resourceType, name)
+	if auth.Limits == nil || len(granted) == 0 {
+		return granted
+	}
+
+	ceiling := &TokenClaims{Access: auth.Limits}
+	var limited []string
+	for _, action := range granted {
+		if checkAccess(ceiling, resourceType, name, action) {
+			limited = append(limited, action)
+		}
+	}
+	return limited
+}
+
+// accountGrantedActions returns the actions the caller's account holds on a resource
+func accountGrantedActions(auth *AuthResult, resourceType, name string) []string {
+	if resourceType == ScopeTypeRegistry {
+		return registryGrantedActions(auth, name)
+	}
+	if resourceType != ScopeTypeRepository || name == "" {
+		return nil
+	}
+	if !AuthEnabled || containsAction(auth.Groups, AdminGroup) {
+		return repositoryActions
+	}
+	// Federated identities hold exactly their rule scopes, applied as Limits
+	if auth.Federated {
+		return repositoryActions
+	}
+
+	// A bearer token can only be exchanged for a subset of its own access
+	if auth.Claims != nil {
+		var granted []string
+		for _, action := range repositoryActions {
+			if CheckAuthorization(auth.Claims, name, action) {
+				granted = append(granted, action)
+			}
+		}
+		return granted
+	}
+
+	policy, err := loadACLPolicy()
+	if err != nil {
+		// Fail closed on a broken policy
+		fmt.Printf("ACL policy error: %v\n", err)
+		return nil
+	}
+
+	var public []string
+	if policy != nil && policy.IsPublic(name) {
+		public = []string{ActionPull}
+	}
+	if auth.Anonymous {
+		return public
+	}
+	if policy == nil || len(policy.Rules) == 0 {
+		// No rules configured: every enabled account may use every repository
+		return repositoryActions
+	}
+	return mergeActions(policy.Actions(auth.Username, auth.Groups, name), public)
+}
+
+// registryGrantedActions returns the caller's actions on a registry-level resource
+func registryGrantedActions(auth *AuthResult, name string) []string {
+	if name != RegistryCatalog && name != RegistryAdmin {
+		return nil
+	}
+	if !AuthEnabled {
+		return registryActions
+	}
+	if auth.Claims != nil {
+		if checkAccess(auth.Claims, ScopeTypeRegistry, name, "*") {
+			return registryActions
+		}
+		return nil
+	}
+
+	switch {
+	case auth.Anonymous:
+		return nil
+	case name == RegistryAdmin:
+		if isAdmin(auth) {
+			return registryActions
+		}
+		return nil
+	default:
+		// Every account may list the catalog
+		return registryActions
+	}
+}
+
+// registryResource returns the registry-level resource a route operates on,
+// or "" for repository routes and endpoints without one
+func registryResource(routeType string) string {
+	switch routeType {
+	case "catalog", "catalog_ext":
+		return RegistryCatalog
+	case "list_users", "get_user", "put_user", "delete_user", "reset_password", "unlock_user", "create_revocation":
+		return RegistryAdmin
+	}
+	return ""
+}
+
+// authorizeRegistryRequest reports whether the caller may use a registry-level
+// resource. Basic callers reach admin endpoints, whose handlers allow
+// self-service; bearer tokens need the registry:admin scope.
+func authorizeRegistryRequest(auth *AuthResult, resource string) bool {
+	if auth.Claims != nil {
+		return checkAccess(auth.Claims, ScopeTypeRegistry, resource, "*")
+	}
+	if resource == RegistryAdmin {
+		return true
+	}
+	return containsAction(grantedActions(auth, ScopeTypeRegistry, resource), "*")
+}
+
+// anonymousAuth admits a request without credentials when it pulls a public
+// repository; otherwise it returns the failed result unchanged
+func anonymousAuth(r *fsthttp.Request, route Route, failed *AuthResult) *AuthResult {
+	if r.Header.Get("Authorization") != "" || route.Name == "" || getRequiredAction(route.Type) != ActionPull {
+		return failed
+	}
+
+	anon := &AuthResult{Authenticated: true, Username: AnonymousAccount, Anonymous: true}
+	if !authorizeRequest(anon, route.Name, ActionPull) {
+		return failed
+	}
+	return anon
+}
+
+// authorizeRequest reports whether the caller may perform action on a repository
+func authorizeRequest(auth *AuthResult, name, action string) bool {
+	if auth.Claims != nil {
+		return CheckAuthorization(auth.Claims, name, action)
+	}
+	return containsAction(grantedActions(auth, ScopeTypeRepository, name), action)
+}
+
+// containsAction reports whether actions includes action
+func containsAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// intersectScopes reduces requested access to what the caller is granted.
+// A requested "*" action expands to the granted actions; entries left with
+// no actions are dropped.
+func intersectScopes(auth *AuthResult, requested []AccessEntry) []AccessEntry {
+	var result []AccessEntry
+	index := make(map[string]int)
+
+	for _, req := range requested {
+		granted := grantedActions(auth, req.Type, req.Name)
+
+		var actions []string
+		for _, action := range granted {
+			for _, want := range req.Actions {
+				if want == action || want == "*" {
+					actions = append(actions, action)
+					break
+				}
+			}
+		}
+
+		if len(actions) < len(req.Actions) {
+			LogSecurityEvent("SCOPE_REDUCED", "", fmt.Sprintf("account=%s resource=%s:%s requested=%v granted=%v",
+				auth.Username, req.Type, req.Name, req.Actions, actions))
+		}
+		if len(actions) == 0 {
+			continue
+		}
+
+		// Merge repeated requests for the same resource
+		key := req.Type + ":" + req.Name
+		if i, ok := index[key]; ok {
+			result[i].Actions = mergeActions(result[i].Actions, actions)
+			continue
+		}
+		index[key] = len(result)
+		result = append(result, AccessEntry{Type: req.Type, Name: req.Name, Actions: actions})
+	}
+
+	return result
+}
+
+// mergeActions returns the union of two action lists, keeping first-seen order
+func mergeActions(a, b []string) []string {
+	merged := append([]string{}, a...)
+	for _, action := range b {
+		if !containsAction(merged, action) {
+			merged = append(merged, action)
+		}
+	}
+	return merged
+}
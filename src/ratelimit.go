@@ -0,0 +1,368 @@
+// Rate Limiting
+//
+// Request limits are enforced by a pluggable RateLimiter. On Fastly the
+// edge rate limiter (rate counters and a penalty box) is shared by every
+// instance in a POP, so limits hold across cold starts and concurrent
+// instances. Local development (fastly compute serve) has no edge rate
+// limiting and uses an in-memory fixed window instead.
+//
+// Edge rate counters are estimates in 10 second buckets; the advertised
+// remaining budget is approximate. A client over its limit is held in the
+// penalty box for RateLimitPenalty and refused until it is released.
+//
+// Every request first passes a per-IP flood guard. After authentication it
+// is charged to a budget per identity and operation class:
+//
+//	identity   anonymous callers by client IP, accounts and robots by subject
+//	operation  pull, push (including deletes and administration), token
+//
+// Budgets come from "config/rate-limits" in the metadata KV store, falling
+// back to defaultRateLimits. Blob HEAD and GET requests cost a fraction of
+// a request, so the layers of a single pull do not exhaust a pull budget.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/erl"
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// Edge rate counter and penalty box names
+	RateCounterName = "registry_requests"
+	PenaltyBoxName  = "registry_penalty"
+
+	// How long a client over its limit is refused (edge limiter, 1-60 minutes)
+	RateLimitPenalty = time.Minute
+
+	// Edge rate limiter entries are limited to 64 characters
+	maxRateLimitEntry = 64
+
+	// KV key (in the metadata store) holding the rate limit tiers
+	RateLimitConfigKey = "config/rate-limits"
+	RateLimitConfigTTL = time.Minute
+
+	// Requests per window per client IP before authentication (flood guard)
+	RateLimitIPCeiling = 3000
+
+	// Request costs, in tenths of a request
+	RateLimitCostUnit = 10
+	BlobHeadCost      = 1
+	BlobGetCost       = 2
+
+	// Operation classes with separate budgets
+	OpPull  = "pull"
+	OpPush  = "push"
+	OpToken = "token"
+)
+
+// RateLimitConfig is the stored rate limit configuration. Limits are
+// requests per RateLimitWindow; zero keeps the default.
+//
+// Example:
+//
+//	{"anonymous":{"pull":100},
+//	 "account":{"pull":1000,"push":300,"token":60},
+//	 "robot":{"pull":5000,"push":1000,"token":300},
+//	 "overrides":{"user:ci-bot":{"pull":20000},"ip:203.0.113.7":{"pull":2000}}}
+type RateLimitConfig struct {
+	Anonymous RateLimitTier            `json:"anonymous"` // Per client IP
+	Account   RateLimitTier            `json:"account"`   // Per authenticated subject
+	Robot     RateLimitTier            `json:"robot"`     // Per robot account
+	Overrides map[string]RateLimitTier `json:"overrides,omitempty"`
+}
+
+// RateLimitTier holds the budget of each operation class
+type RateLimitTier struct {
+	Pull  int `json:"pull,omitempty"`
+	Push  int `json:"push,omitempty"`
+	Token int `json:"token,omitempty"`
+}
+
+// defaultRateLimits applies where the stored configuration sets no limit
+var defaultRateLimits = RateLimitConfig{
+	Anonymous: RateLimitTier{Pull: RateLimitMaxRequests, Push: RateLimitMaxRequests, Token: 30},
+	Account:   RateLimitTier{Pull: 1000, Push: 300, Token: 60},
+	Robot:     RateLimitTier{Pull: 5000, Push: 1000, Token: 300},
+}
+
+// Cached rate limit configuration
+var (
+	rateLimitConfig       *RateLimitConfig
+	rateLimitConfigLoaded time.Time
+	rateLimitConfigMu     sync.Mutex
+)
+
+// RateLimiter charges cost against a key's limit per RateLimitWindow
+type RateLimiter interface {
+	Allow(key string, cost, limit int) RateLimitResult
+}
+
+// RateLimitResult is the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter int // seconds until the client may retry (when refused) or the window resets
+}
+
+var (
+	rateLimiter     RateLimiter
+	rateLimiterOnce sync.Once
+)
+
+// getRateLimiter returns the limiter for this environment
+func getRateLimiter() RateLimiter {
+	rateLimiterOnce.Do(func() {
+		if isLocalMode() {
+			rateLimiter = newMemoryRateLimiter()
+		} else {
+			rateLimiter = newEdgeRateLimiter()
+		}
+	})
+	return rateLimiter
+}
+
+// CheckRateLimit applies the per-IP flood guard before authentication
+func CheckRateLimit(r *fsthttp.Request) RateLimitResult {
+	if !RateLimitEnabled {
+		return RateLimitResult{Allowed: true, Limit: RateLimitIPCeiling, Remaining: RateLimitIPCeiling}
+	}
+	return getRateLimiter().Allow("all|ip:"+getClientIP(r), 1, RateLimitIPCeiling)
+}
+
+// CheckOperationLimit charges a request to the caller's budget for an
+// operation class. Limit and Remaining are reported in whole requests.
+func CheckOperationLimit(r *fsthttp.Request, auth *AuthResult, op string, cost int) RateLimitResult {
+	identity := "ip:" + getClientIP(r)
+	config := loadRateLimitConfig()
+	tier := config.Anonymous
+	defaults := defaultRateLimits.Anonymous
+	if auth != nil && auth.Authenticated && !auth.Anonymous && auth.Username != "" && auth.Username != AnonymousAccount {
+		identity = "user:" + auth.Username
+		tier, defaults = config.Account, defaultRateLimits.Account
+		if auth.Robot {
+			tier, defaults = config.Robot, defaultRateLimits.Robot
+		}
+	}
+
+	limit := tier.limit(op)
+	if override, ok := config.Overrides[identity]; ok && override.limit(op) > 0 {
+		limit = override.limit(op)
+	}
+	if limit <= 0 {
+		limit = defaults.limit(op)
+	}
+
+	if !RateLimitEnabled {
+		return RateLimitResult{Allowed: true, Limit: limit, Remaining: limit}
+	}
+	result := getRateLimiter().Allow(op+"|"+identity, cost, limit*RateLimitCostUnit)
+	result.Limit = limit
+	result.Remaining /= RateLimitCostUnit
+	return result
+}
+
+// routeOperation classifies a route for rate limiting and returns its cost.
+// The token endpoint is charged when a token is issued.
+func routeOperation(routeType string) (string, int) {
+	switch routeType {
+	case "head_blob":
+		return OpPull, BlobHeadCost
+	case "get_blob":
+		return OpPull, BlobGetCost
+	}
+	if getRequiredAction(routeType) == ActionPull {
+		return OpPull, RateLimitCostUnit
+	}
+	return OpPush, RateLimitCostUnit
+}
+
+// limit returns the tier's budget for an operation class
+func (t RateLimitTier) limit(op string) int {
+	switch op {
+	case OpPull:
+		return t.Pull
+	case OpPush:
+		return t.Push
+	case OpToken:
+		return t.Token
+	}
+	return 0
+}
+
+// withDefaults fills the classes the tier leaves unset from defaults
+func (t RateLimitTier) withDefaults(defaults RateLimitTier) RateLimitTier {
+	if t.Pull <= 0 {
+		t.Pull = defaults.Pull
+	}
+	if t.Push <= 0 {
+		t.Push = defaults.Push
+	}
+	if t.Token <= 0 {
+		t.Token = defaults.Token
+	}
+	return t
+}
+
+// loadRateLimitConfig returns the stored configuration, cached briefly
+func loadRateLimitConfig() *RateLimitConfig {
+	rateLimitConfigMu.Lock()
+	defer rateLimitConfigMu.Unlock()
+
+	if rateLimitConfig != nil && time.Since(rateLimitConfigLoaded) < RateLimitConfigTTL {
+		return rateLimitConfig
+	}
+
+	config := &RateLimitConfig{}
+	if store, err := kvstore.Open(KVStoreMetadata); err == nil {
+		if entry, err := store.Lookup(RateLimitConfigKey); err == nil {
+			body, _ := io.ReadAll(entry)
+			if err := json.Unmarshal(body, config); err != nil {
+				fmt.Printf("Invalid rate limit configuration: %v\n", err)
+				config = &RateLimitConfig{}
+			}
+		}
+	}
+
+	rateLimitConfig = config
+	rateLimitConfigLoaded = time.Now()
+	return config
+}
+
+// memoryRateLimiter is a process-local fixed window (resets on cold start)
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*rateLimitEntry
+}
+
+type rateLimitEntry struct {
+	Count     int
+	ResetTime time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{entries: make(map[string]*rateLimitEntry)}
+}
+
+func (m *memoryRateLimiter) Allow(key string, cost, limit int) RateLimitResult {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, exists := m.entries[key]
+	if !exists || now.After(entry.ResetTime) {
+		// New window
+		entry = &rateLimitEntry{ResetTime: now.Add(time.Duration(RateLimitWindow) * time.Second)}
+		m.entries[key] = entry
+	}
+	entry.Count += cost
+
+	result := RateLimitResult{
+		Allowed:    entry.Count <= limit,
+		Limit:      limit,
+		Remaining:  limit - entry.Count,
+		RetryAfter: int(entry.ResetTime.Sub(now).Seconds()) + 1,
+	}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	return result
+}
+
+// edgeRateLimiter uses Fastly's edge rate counters and penalty box
+type edgeRateLimiter struct {
+	counter *erl.RateCounter
+	penalty *erl.PenaltyBox
+}
+
+func newEdgeRateLimiter() *edgeRateLimiter {
+	return &edgeRateLimiter{
+		counter: erl.OpenRateCounter(RateCounterName),
+		penalty: erl.OpenPenaltyBox(PenaltyBoxName),
+	}
+}
+
+func (e *edgeRateLimiter) Allow(key string, cost, limit int) RateLimitResult {
+	entry := rateLimitEntryName(key)
+	penalty := int(RateLimitPenalty / time.Second)
+
+	if blocked, err := e.penalty.Has(entry); err != nil {
+		// Fail open: the limiter must not take the registry down
+		fmt.Printf("Rate limiter error: %v\n", err)
+		return RateLimitResult{Allowed: true, Limit: limit, Remaining: limit}
+	} else if blocked {
+		return RateLimitResult{Allowed: false, Limit: limit, Remaining: 0, RetryAfter: penalty}
+	}
+
+	if err := e.counter.Increment(entry, uint32(cost)); err != nil {
+		fmt.Printf("Rate limiter error: %v\n", err)
+		return RateLimitResult{Allowed: true, Limit: limit, Remaining: limit}
+	}
+	count, err := e.counter.LookupCount(entry, counterDuration(RateLimitWindow))
+	if err != nil {
+		fmt.Printf("Rate limiter error: %v\n", err)
+		return RateLimitResult{Allowed: true, Limit: limit, Remaining: limit}
+	}
+
+	if int(count) > limit {
+		if err := e.penalty.Add(entry, RateLimitPenalty); err != nil {
+			fmt.Printf("Rate limiter error: %v\n", err)
+		}
+		return RateLimitResult{Allowed: false, Limit: limit, Remaining: 0, RetryAfter: penalty}
+	}
+
+	// Counter buckets roll over every 10 seconds
+	return RateLimitResult{
+		Allowed:    true,
+		Limit:      limit,
+		Remaining:  limit - int(count),
+		RetryAfter: 10 - int(time.Now().Unix()%10),
+	}
+}
+
+// counterDuration maps a window in seconds to the nearest edge counter duration
+func counterDuration(window int) erl.CounterDuration {
+	switch {
+	case window <= 10:
+		return erl.CounterDuration10s
+	case window <= 20:
+		return erl.CounterDuration20s
+	case window <= 30:
+		return erl.CounterDuration30s
+	case window <= 40:
+		return erl.CounterDuration40s
+	case window <= 50:
+		return erl.CounterDuration50s
+	default:
+		return erl.CounterDuration60s
+	}
+}
+
+// rateLimitEntryName shortens keys that exceed the edge entry length
+func rateLimitEntryName(key string) string {
+	if len(key) <= maxRateLimitEntry {
+		return key
+	}
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:16])
+}
+
+// setRateLimitHeaders reports the client's budget on the response
+func setRateLimitHeaders(w fsthttp.ResponseWriter, result RateLimitResult) {
+	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+	if result.RetryAfter > 0 {
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", result.RetryAfter))
+	}
+}
@@ -0,0 +1,300 @@
+// Repository Metadata
+//
+// Each repository has a record in the metadata KV store ("repos/<name>"),
+// created on first push beside the catalog index. It carries user-editable
+// metadata, exposed through registry extension endpoints:
+//
+//	GET /v2/<name>/_edgeoci/metadata
+//	PUT /v2/<name>/_edgeoci/metadata
+//	GET /v2/_edgeoci/catalog?q=<search>&label=<key=value>&n=<n>&last=<name>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// Limits for user-supplied metadata
+	MaxRepoDescriptionLength = 1024
+	MaxRepoReadmeSize        = 256 * 1024
+	MaxRepoLabels            = 64
+
+	// The catalog extension reads one record per repository it scans, so
+	// pages are capped; a filtered request stops after MaxCatalogScan records
+	// and links to the next page from where it stopped
+	MaxCatalogPageSize = 100
+	MaxCatalogScan     = 500
+)
+
+// RepositoryRecord is the per-repository catalog entry ("repos/<name>")
+type RepositoryRecord struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Readme      string            `json:"readme,omitempty"` // Markdown
+	Owner       string            `json:"owner,omitempty"`  // Owning team
+	Labels      map[string]string `json:"labels,omitempty"`
+	CreatedAt   string            `json:"created_at"`
+	UpdatedAt   string            `json:"updated_at,omitempty"`
+	UpdatedBy   string            `json:"updated_by,omitempty"`
+}
+
+// RepositoryMetadataUpdate is the body of a metadata PUT; it replaces all editable fields
+type RepositoryMetadataUpdate struct {
+	Description string            `json:"description"`
+	Readme      string            `json:"readme"`
+	Owner       string            `json:"owner"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// CatalogEntry is a repository in the catalog extension (README omitted)
+type CatalogEntry struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	CreatedAt   string            `json:"created_at,omitempty"`
+}
+
+// CatalogExtension response for GET /v2/_edgeoci/catalog
+type CatalogExtension struct {
+	Repositories []CatalogEntry `json:"repositories"`
+}
+
+func repositoryKey(name string) string {
+	return fmt.Sprintf("repos/%s", name)
+}
+
+// loadRepositoryRecord loads a repository record. Repositories created before
+// records existed are found through the catalog and get an empty record.
+func loadRepositoryRecord(store *kvstore.Store, name string) (*RepositoryRecord, error) {
+	if record := lookupRepositoryRecord(store, name); record != nil {
+		return record, nil
+	}
+
+	repos, err := catalogIndex(store).List()
+	if err != nil {
+		return nil, err
+	}
+	for _, repo := range repos {
+		if repo == name {
+			return &RepositoryRecord{Name: name}, nil
+		}
+	}
+
+	return nil, &OCIError{Code: "NAME_UNKNOWN", Message: "repository name not known to registry", Detail: name, Status: fsthttp.StatusNotFound}
+}
+
+// lookupRepositoryRecord returns the stored record for a repository, or nil
+func lookupRepositoryRecord(store *kvstore.Store, name string) *RepositoryRecord {
+	entry, err := store.Lookup(repositoryKey(name))
+	if err != nil {
+		return nil
+	}
+	body, _ := io.ReadAll(entry)
+	var record RepositoryRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil
+	}
+	return &record
+}
+
+// handleGetRepositoryMetadata handles GET /v2/<name>/_edgeoci/metadata
+func handleGetRepositoryMetadata(_ context.Context, w fsthttp.ResponseWriter, name string) error {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	record, err := loadRepositoryRecord(store, name)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(record)
+	return nil
+}
+
+// handlePutRepositoryMetadata handles PUT /v2/<name>/_edgeoci/metadata
+func handlePutRepositoryMetadata(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, name, account string) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxRepoReadmeSize+64*1024))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	var update RepositoryMetadataUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: "invalid repository metadata", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+	}
+	if err := validateRepositoryMetadata(&update); err != nil {
+		return err
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	record, err := loadRepositoryRecord(store, name)
+	if err != nil {
+		return err
+	}
+
+	record.Description = update.Description
+	record.Readme = update.Readme
+	record.Owner = update.Owner
+	record.Labels = update.Labels
+	record.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	record.UpdatedBy = account
+
+	value, _ := json.Marshal(record)
+	if err := store.Insert(repositoryKey(name), strings.NewReader(string(value))); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(record)
+	return nil
+}
+
+// validateRepositoryMetadata enforces size limits on user-supplied metadata
+func validateRepositoryMetadata(update *RepositoryMetadataUpdate) error {
+	switch {
+	case len(update.Description) > MaxRepoDescriptionLength:
+		return &OCIError{Code: "SIZE_INVALID", Message: fmt.Sprintf("description exceeds %d characters", MaxRepoDescriptionLength), Status: fsthttp.StatusBadRequest}
+	case len(update.Readme) > MaxRepoReadmeSize:
+		return &OCIError{Code: "SIZE_INVALID", Message: fmt.Sprintf("readme exceeds %d bytes", MaxRepoReadmeSize), Status: fsthttp.StatusBadRequest}
+	case len(update.Owner) > 256:
+		return &OCIError{Code: "SIZE_INVALID", Message: "owner exceeds 256 characters", Status: fsthttp.StatusBadRequest}
+	case len(update.Labels) > MaxRepoLabels:
+		return &OCIError{Code: "SIZE_INVALID", Message: fmt.Sprintf("more than %d labels", MaxRepoLabels), Status: fsthttp.StatusBadRequest}
+	}
+	for key, value := range update.Labels {
+		if key == "" || len(key) > 128 || len(value) > 256 {
+			return &OCIError{Code: "UNSUPPORTED", Message: "label keys must be 1-128 characters and values at most 256", Detail: key, Status: fsthttp.StatusBadRequest}
+		}
+	}
+	return nil
+}
+
+// handleCatalogExtension handles GET /v2/_edgeoci/catalog: the catalog with
+// repository metadata, optionally filtered by a search term and labels. Only
+// repositories the caller may pull are listed.
+func handleCatalogExtension(_ context.Context, w fsthttp.ResponseWriter, query string, auth *AuthResult) error {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	n, last := ParsePaginationParams(query)
+	if n > MaxCatalogPageSize {
+		n = MaxCatalogPageSize
+	}
+	rawSearch := extractQueryParam(query, "q")
+	rawLabel := extractQueryParam(query, "label")
+	search := strings.ToLower(rawSearch)
+	labelKey, labelValue, hasLabel := strings.Cut(rawLabel, "=")
+	filtering := search != "" || labelKey != ""
+
+	repos, err := catalogIndex(store).List()
+	if err != nil {
+		return err
+	}
+
+	var entries []CatalogEntry
+	hasMore := false
+	cursor := ""
+	scanned := 0
+	for _, name := range repos {
+		if last != "" && name <= last {
+			continue
+		}
+		if len(entries) == n || scanned == MaxCatalogScan {
+			hasMore = true
+			break
+		}
+
+		scanned++
+		cursor = name
+		if !authorizeRequest(auth, name, ActionPull) {
+			continue
+		}
+		record := lookupRepositoryRecord(store, name)
+		if record == nil {
+			record = &RepositoryRecord{Name: name}
+		}
+
+		if filtering {
+			if search != "" && !repositoryMatchesSearch(record, search) {
+				continue
+			}
+			if labelKey != "" {
+				value, ok := record.Labels[labelKey]
+				if !ok || (hasLabel && value != labelValue) {
+					continue
+				}
+			}
+		}
+
+		entries = append(entries, CatalogEntry{
+			Name:        record.Name,
+			Description: record.Description,
+			Owner:       record.Owner,
+			Labels:      record.Labels,
+			CreatedAt:   record.CreatedAt,
+		})
+	}
+
+	// The cursor is the last repository scanned, which may not have matched
+	if hasMore && cursor != "" {
+		next := url.Values{}
+		next.Set("n", strconv.Itoa(n))
+		next.Set("last", cursor)
+		if rawSearch != "" {
+			next.Set("q", rawSearch)
+		}
+		if rawLabel != "" {
+			next.Set("label", rawLabel)
+		}
+		w.Header().Set("Link", fmt.Sprintf(`</v2/%s/catalog?%s>; rel="next"`, ExtensionNamespace, next.Encode()))
+	}
+
+	response := CatalogExtension{Repositories: entries}
+	if response.Repositories == nil {
+		response.Repositories = []CatalogEntry{}
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	return nil
+}
+
+// repositoryMatchesSearch does a case-insensitive substring match on name,
+// description, owner and labels
+func repositoryMatchesSearch(record *RepositoryRecord, search string) bool {
+	if strings.Contains(strings.ToLower(record.Name), search) ||
+		strings.Contains(strings.ToLower(record.Description), search) ||
+		strings.Contains(strings.ToLower(record.Owner), search) {
+		return true
+	}
+	for key, value := range record.Labels {
+		if strings.Contains(strings.ToLower(key), search) || strings.Contains(strings.ToLower(value), search) {
+			return true
+		}
+	}
+	return false
+}
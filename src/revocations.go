@@ -0,0 +1,209 @@
+// Bearer Token Revocation
+//
+// Registry tokens are stateless JWTs, so a leaked token would otherwise stay
+// valid until it expires. Revocations are recorded in the metadata KV store
+// and checked on every bearer token validation:
+//
+//	revoked/jti/<jti>      a single token, by its jti claim
+//	revoked/sub/<subject>  every token issued to a subject before not_before
+//
+// The KV store has no TTL, so each record carries the time after which the
+// tokens it covers have expired anyway; stale records are ignored and
+// removed when next read.
+//
+//	POST /v2/_edgeoci/revocations  {"token":"<jwt>"}      anyone holding the token
+//	                               {"jti":"<jti>"}        admin
+//	                               {"subject":"<name>"}   admin, or the account itself
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// KV key prefixes (in the metadata store) for revocation records
+	RevokedJTIPrefix     = "revoked/jti/"
+	RevokedSubjectPrefix = "revoked/sub/"
+
+	// Maximum size of a revocation request body
+	MaxRevocationRequestSize = 64 * 1024
+)
+
+// errTokenRevoked is returned by ValidateBearerToken for revoked tokens
+var errTokenRevoked = errors.New("token revoked")
+
+// TokenRevocation is a stored revocation record
+type TokenRevocation struct {
+	JTI       string `json:"jti,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	NotBefore int64  `json:"not_before,omitempty"` // Subject tokens issued before this are revoked
+	ExpiresAt int64  `json:"expires_at"`           // Record is obsolete after this
+	RevokedAt int64  `json:"revoked_at"`
+	RevokedBy string `json:"revoked_by"`
+}
+
+// RevocationRequest is the body of POST /v2/_edgeoci/revocations
+type RevocationRequest struct {
+	Token   string `json:"token,omitempty"`
+	JTI     string `json:"jti,omitempty"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// tokenRevoked reports whether a token was revoked by jti or by subject
+func tokenRevoked(claims *TokenClaims) bool {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		// Fail closed: a revoked token must not pass while KV is unavailable
+		fmt.Printf("Revocation check failed: %v\n", err)
+		return true
+	}
+
+	if claims.JWTID != "" {
+		if record := loadRevocation(store, RevokedJTIPrefix+claims.JWTID); record != nil {
+			return true
+		}
+	}
+	if claims.Subject != "" {
+		if record := loadRevocation(store, RevokedSubjectPrefix+claims.Subject); record != nil && claims.IssuedAt < record.NotBefore {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRevocation reads a revocation record, dropping it once obsolete
+func loadRevocation(store *kvstore.Store, key string) *TokenRevocation {
+	entry, err := store.Lookup(key)
+	if err != nil {
+		return nil
+	}
+
+	body, _ := io.ReadAll(entry)
+	var record TokenRevocation
+	if err := json.Unmarshal(body, &record); err != nil {
+		return nil
+	}
+	if time.Now().Unix() > record.ExpiresAt {
+		store.Delete(key)
+		return nil
+	}
+	return &record
+}
+
+// saveRevocation stores a revocation record
+func saveRevocation(store *kvstore.Store, key string, record *TokenRevocation) error {
+	data, _ := json.Marshal(record)
+	if err := store.Insert(key, strings.NewReader(string(data))); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	return nil
+}
+
+// revokeSubjectTokens revokes every token issued to a subject until now
+func revokeSubjectTokens(store *kvstore.Store, subject, by string) error {
+	now := time.Now().Unix()
+	return saveRevocation(store, RevokedSubjectPrefix+subject, &TokenRevocation{
+		Subject:   subject,
+		NotBefore: now,
+		ExpiresAt: now + RefreshTokenExpiry,
+		RevokedAt: now,
+		RevokedBy: by,
+	})
+}
+
+// handleCreateRevocation handles POST /v2/_edgeoci/revocations
+func handleCreateRevocation(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, auth *AuthResult) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, MaxRevocationRequestSize))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	var req RevocationRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: "invalid revocation request", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+	}
+
+	set := 0
+	for _, v := range []string{req.Token, req.JTI, req.Subject} {
+		if v != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return &OCIError{Code: "UNSUPPORTED", Message: "exactly one of token, jti or subject is required", Status: fsthttp.StatusBadRequest}
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	now := time.Now().Unix()
+
+	switch {
+	case req.Token != "":
+		// Holding a token is enough to revoke it
+		claims, err := ValidateBearerToken(r, req.Token)
+		if errors.Is(err, errTokenRevoked) {
+			w.WriteHeader(fsthttp.StatusAccepted)
+			return nil
+		}
+		if err != nil {
+			return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("invalid token: %s", err.Error()), Status: fsthttp.StatusBadRequest}
+		}
+		if claims.JWTID == "" {
+			return &OCIError{Code: "UNSUPPORTED", Message: "token has no jti", Status: fsthttp.StatusBadRequest}
+		}
+		if err := saveRevocation(store, RevokedJTIPrefix+claims.JWTID, &TokenRevocation{
+			JTI:       claims.JWTID,
+			Subject:   claims.Subject,
+			ExpiresAt: claims.ExpiresAt,
+			RevokedAt: now,
+			RevokedBy: auth.Username,
+		}); err != nil {
+			return err
+		}
+		LogSecurityEvent("TOKEN_REVOKED", getClientIP(r), fmt.Sprintf("jti=%s subject=%s by=%s", claims.JWTID, claims.Subject, auth.Username))
+
+	case req.JTI != "":
+		if !isAdmin(auth) {
+			return adminRequiredError()
+		}
+		if len(req.JTI) > 128 || strings.ContainsAny(req.JTI, "/ ") {
+			return &OCIError{Code: "UNSUPPORTED", Message: "invalid jti", Detail: req.JTI, Status: fsthttp.StatusBadRequest}
+		}
+		// The token's expiry is unknown; keep the record as long as any token can live
+		if err := saveRevocation(store, RevokedJTIPrefix+req.JTI, &TokenRevocation{
+			JTI:       req.JTI,
+			ExpiresAt: now + RefreshTokenExpiry,
+			RevokedAt: now,
+			RevokedBy: auth.Username,
+		}); err != nil {
+			return err
+		}
+		LogSecurityEvent("TOKEN_REVOKED", getClientIP(r), fmt.Sprintf("jti=%s by=%s", req.JTI, auth.Username))
+
+	default:
+		if (req.Subject != auth.Username || auth.Anonymous) && !isAdmin(auth) {
+			return adminRequiredError()
+		}
+		if len(req.Subject) > 256 {
+			return &OCIError{Code: "UNSUPPORTED", Message: "invalid subject", Status: fsthttp.StatusBadRequest}
+		}
+		if err := revokeSubjectTokens(store, req.Subject, auth.Username); err != nil {
+			return err
+		}
+		LogSecurityEvent("TOKEN_REVOKED", getClientIP(r), fmt.Sprintf("subject=%s by=%s", req.Subject, auth.Username))
+	}
+
+	w.WriteHeader(fsthttp.StatusAccepted)
+	return nil
+}
@@ -149,6 +149,76 @@ func SignCopyRequest(destKey, sourceKey string) (*fsthttp.Request, error) {
 	return req, nil
 }
 
+// SignListObjectsRequest creates a signed ListObjectsV2 request for the keys
+// under prefix, continuing from a previous page's continuation token
+func SignListObjectsRequest(prefix, continuationToken string) (*fsthttp.Request, error) {
+	accessKey, secretKey, err := loadCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %w", err)
+	}
+
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	datetime := now.Format("20060102T150405Z")
+
+	uri := fmt.Sprintf("/%s", S3Bucket)
+
+	// Canonical query: parameters sorted by name, values URI-encoded
+	queryString := ""
+	if continuationToken != "" {
+		queryString = "continuation-token=" + s3URIEncode(continuationToken) + "&"
+	}
+	queryString += "list-type=2&prefix=" + s3URIEncode(prefix)
+
+	payloadHash := sha256Hex([]byte{})
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		FastlyOSHost, payloadHash, datetime)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := fmt.Sprintf("GET\n%s\n%s\n%s\n%s\n%s",
+		uri, queryString, canonicalHeaders, signedHeaders, payloadHash)
+
+	canonicalHash := sha256Hex([]byte(canonicalRequest))
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, FastlyOSRegion, S3Service)
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s",
+		datetime, scope, canonicalHash)
+
+	signature := calculateSignature(secretKey, date, stringToSign)
+
+	authHeader := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature)
+
+	url := fmt.Sprintf("https://%s%s?%s", FastlyOSHost, uri, queryString)
+	req, err := fsthttp.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Host", FastlyOSHost)
+	req.Header.Set("x-amz-date", datetime)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	req.Header.Set("Authorization", authHeader)
+
+	return req, nil
+}
+
+// s3URIEncode percent-encodes everything but unreserved characters, as
+// SigV4 canonical query strings require
+func s3URIEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
 func signRequest(method, key, contentType string) (*fsthttp.Request, error) {
 	accessKey, secretKey, err := loadCredentials()
 	if err != nil {
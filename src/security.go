@@ -8,8 +8,8 @@ package main
 import (
 	"crypto/subtle"
 	"fmt"
+	"net/netip"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/fastly/compute-sdk-go/fsthttp"
@@ -30,17 +30,6 @@ const (
 	EnableSecurityHeaders = true
 )
 
-// In-memory rate limiter (resets on cold start, which is fine for edge)
-var (
-	rateLimitStore = make(map[string]*rateLimitEntry)
-	rateLimitMu    sync.Mutex
-)
-
-type rateLimitEntry struct {
-	Count     int
-	ResetTime time.Time
-}
-
 // AddSecurityHeaders adds security headers to the response
 // These follow OWASP recommendations for API security
 func AddSecurityHeaders(w fsthttp.ResponseWriter) {
@@ -68,69 +57,88 @@ func AddSecurityHeaders(w fsthttp.ResponseWriter) {
 	w.Header().Set("Pragma", "no-cache")
 }
 
-// CheckRateLimit checks if the client has exceeded rate limits
-// Returns true if request should proceed, false if rate limited
-func CheckRateLimit(r *fsthttp.Request) (bool, int, int) {
-	if !RateLimitEnabled {
-		return true, 0, RateLimitMaxRequests
-	}
-
-	clientIP := getClientIP(r)
-	now := time.Now()
-
-	rateLimitMu.Lock()
-	defer rateLimitMu.Unlock()
-
-	entry, exists := rateLimitStore[clientIP]
-	if !exists || now.After(entry.ResetTime) {
-		// New window
-		rateLimitStore[clientIP] = &rateLimitEntry{
-			Count:     1,
-			ResetTime: now.Add(time.Duration(RateLimitWindow) * time.Second),
-		}
-		return true, 1, RateLimitMaxRequests
-	}
-
-	entry.Count++
-	remaining := RateLimitMaxRequests - entry.Count
-
-	if entry.Count > RateLimitMaxRequests {
-		return false, entry.Count, 0
-	}
-
-	return true, entry.Count, remaining
-}
-
 // WriteRateLimitResponse writes a 429 Too Many Requests response
-func WriteRateLimitResponse(w fsthttp.ResponseWriter, retryAfter int) {
-	w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
-	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", RateLimitMaxRequests))
-	w.Header().Set("X-RateLimit-Remaining", "0")
+func WriteRateLimitResponse(w fsthttp.ResponseWriter, result RateLimitResult) {
+	setRateLimitHeaders(w, result)
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", result.RetryAfter))
 	w.Header().Set("Content-Type", ContentTypeJSON)
 	w.WriteHeader(fsthttp.StatusTooManyRequests)
 	w.Write([]byte(`{"errors":[{"code":"TOOMANYREQUESTS","message":"rate limit exceeded, retry later"}]}`))
 }
 
-// getClientIP extracts the client IP from request headers
-// Handles X-Forwarded-For, X-Real-IP, and falls back to Fastly headers
+// TrustedProxies lists the networks (CIDR prefixes) whose forwarding headers
+// are believed: a Fastly shield POP or another proxy in front of the service.
+// Every other client is identified by its connecting address, since
+// Fastly-Client-IP, X-Forwarded-For and X-Real-IP arrive from the client
+// unchanged and can be set to anything.
+var TrustedProxies = []string{}
+
+// getClientIP returns the address of the client. Forwarding headers are
+// only used when the connection comes from a trusted proxy.
 func getClientIP(r *fsthttp.Request) string {
-	// Fastly provides the real client IP
-	if ip := r.Header.Get("Fastly-Client-IP"); ip != "" {
-		return ip
+	remote, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return "unknown"
+	}
+	if !trustedProxy(remote) {
+		return remote.String()
 	}
 
-	// Check X-Forwarded-For (take first IP in chain)
+	// Set by the edge POP that forwarded to this shield
+	if ip, ok := parseIP(r.Header.Get("Fastly-Client-IP")); ok {
+		return ip.String()
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxies; the
+	// entries left of the first untrusted hop are client-supplied
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		parts := strings.Split(xff, ",")
-		return strings.TrimSpace(parts[0])
+		for i := len(parts) - 1; i >= 0; i-- {
+			ip, ok := parseIP(parts[i])
+			if !ok {
+				break
+			}
+			if !trustedProxy(ip) {
+				return ip.String()
+			}
+		}
 	}
 
-	// Check X-Real-IP
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
+	if ip, ok := parseIP(r.Header.Get("X-Real-IP")); ok {
+		return ip.String()
 	}
 
-	return "unknown"
+	return remote.String()
+}
+
+// parseIP parses an address, with or without a port
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return netip.Addr{}, false
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
+
+// trustedProxy reports whether an address belongs to TrustedProxies
+func trustedProxy(ip netip.Addr) bool {
+	for _, cidr := range TrustedProxies {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			continue
+		}
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 // ValidateRepositoryName checks if repository name follows OCI naming rules
@@ -354,12 +362,14 @@ func isAllowedOrigin(origin string) bool {
 
 func getRequiredAction(routeType string) string {
 	switch routeType {
-	case "get_manifest", "head_manifest", "get_blob", "head_blob", "list_tags", "catalog", "referrers":
+	case "get_manifest", "head_manifest", "get_blob", "head_blob", "list_tags", "catalog", "referrers", "tag_history", "ext_discover", "get_repo_metadata", "catalog_ext":
 		return "pull"
-	case "put_manifest", "initiate_upload", "upload_chunk", "complete_upload", "mount_blob":
+	case "put_manifest", "initiate_upload", "upload_chunk", "complete_upload", "mount_blob", "put_repo_metadata":
 		return "push"
 	case "delete_manifest", "delete_blob":
 		return "delete"
+	case "tag_rollback", "list_users", "get_user", "put_user", "delete_user", "reset_password", "unlock_user", "list_tokens", "create_token", "revoke_token", "create_revocation":
+		return "admin"
 	default:
 		return "pull"
 	}
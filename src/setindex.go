@@ -0,0 +1,298 @@
+// Set Indexes
+//
+// Tag lists, the repository catalog, accounts, access tokens and tag history
+// entries are sets that must be enumerable. compute-sdk-go v1.3.2 can neither
+// list KV keys nor make generation-matched inserts, so any set kept in a KV
+// value is a read-modify-write that concurrent writers clobber. Instead each
+// member is its own empty marker object in Object Storage, listed with
+// ListObjectsV2:
+//
+//	index/<set>/<hex(member)>    a member
+//	unindex/<set>/<hex(member)>  a member removed from the legacy KV shards
+//
+// Adding or removing a member only touches its own object, so concurrent
+// updates never overwrite each other. Hex keeps any member (repository paths,
+// digests) to characters that need no escaping, and sorts like the member.
+//
+// Sets used to be JSON arrays in KV shard keys ("<set>/00".."<set>/15", and
+// an older single key for tags and the catalog). Those are still read and
+// merged, but never written: removing a legacy member records an unindex
+// marker instead.
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// Number of legacy KV shard keys per set
+	KVIndexShards = 16
+
+	// Object Storage prefixes of member and removal markers
+	SetIndexPrefix   = "index/"
+	SetUnindexPrefix = "unindex/"
+
+	// ListObjectsV2 pages read per listing (1000 keys each)
+	MaxSetIndexPages = 20
+)
+
+// setIndex is an enumerable set of strings, one marker object per member
+type setIndex struct {
+	store     *kvstore.Store
+	prefix    string // Set name; legacy shard keys are "<prefix>/<shard>"
+	legacyKey string // Pre-sharding JSON array key (optional)
+}
+
+// ListBucketResult is the XML response of ListObjectsV2
+type ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// tagIndex returns the tag index for a repository
+func tagIndex(store *kvstore.Store, name string) *setIndex {
+	return &setIndex{
+		store:     store,
+		prefix:    "tagindex/" + name,
+		legacyKey: fmt.Sprintf("taglist/%s", name),
+	}
+}
+
+// tagHistoryIndex returns the history entry index for a tag
+func tagHistoryIndex(store *kvstore.Store, name, tag string) *setIndex {
+	return &setIndex{
+		store:  store,
+		prefix: fmt.Sprintf("taghistoryindex/%s/%s", name, tag),
+	}
+}
+
+// userIndex returns the account index
+func userIndex(store *kvstore.Store) *setIndex {
+	return &setIndex{
+		store:  store,
+		prefix: "userindex",
+	}
+}
+
+// accessTokenIndex returns the access token index
+func accessTokenIndex(store *kvstore.Store) *setIndex {
+	return &setIndex{
+		store:  store,
+		prefix: "patindex",
+	}
+}
+
+// catalogIndex returns the repository index
+func catalogIndex(store *kvstore.Store) *setIndex {
+	return &setIndex{
+		store:     store,
+		prefix:    "catalogindex",
+		legacyKey: "catalog",
+	}
+}
+
+// markerKey returns the object key of a member's marker under base
+func (ix *setIndex) markerKey(base, member string) string {
+	return base + ix.prefix + "/" + hex.EncodeToString([]byte(member))
+}
+
+// Add inserts member into the set
+func (ix *setIndex) Add(member string) error {
+	return ix.sendMarker("PUT", ix.markerKey(SetIndexPrefix, member))
+}
+
+// Remove deletes member from the set
+func (ix *setIndex) Remove(member string) error {
+	if err := ix.sendMarker("DELETE", ix.markerKey(SetIndexPrefix, member)); err != nil {
+		return err
+	}
+	for _, m := range ix.legacyMembers() {
+		if m == member {
+			return ix.sendMarker("PUT", ix.markerKey(SetUnindexPrefix, member))
+		}
+	}
+	return nil
+}
+
+// Contains reports whether member is in the set
+func (ix *setIndex) Contains(member string) (bool, error) {
+	found, err := ix.markerExists(ix.markerKey(SetIndexPrefix, member))
+	if err != nil || found {
+		return found, err
+	}
+	for _, m := range ix.legacyMembers() {
+		if m == member {
+			removed, err := ix.markerExists(ix.markerKey(SetUnindexPrefix, member))
+			return !removed, err
+		}
+	}
+	return false, nil
+}
+
+// List returns all members of the set, sorted and de-duplicated
+func (ix *setIndex) List() ([]string, error) {
+	members, err := ix.listMarkers(SetIndexPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		seen[m] = true
+	}
+
+	if legacy := ix.legacyMembers(); len(legacy) > 0 {
+		removed, err := ix.listMarkers(SetUnindexPrefix)
+		if err != nil {
+			return nil, err
+		}
+		unindexed := make(map[string]bool, len(removed))
+		for _, m := range removed {
+			unindexed[m] = true
+		}
+		for _, m := range legacy {
+			if m != "" && !seen[m] && !unindexed[m] {
+				seen[m] = true
+				members = append(members, m)
+			}
+		}
+	}
+
+	sort.Strings(members)
+	return members, nil
+}
+
+// sendMarker writes or deletes a marker object
+func (ix *setIndex) sendMarker(method, key string) error {
+	var req *fsthttp.Request
+	var err error
+	if method == "PUT" {
+		req, err = SignPutRequest(key, "application/octet-stream")
+	} else {
+		req, err = SignDeleteRequest(key)
+	}
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("S3 auth error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if method == "PUT" {
+		req.Header.Set("Content-Length", "0")
+	}
+	req.CacheOptions.Pass = true
+
+	resp, err := req.Send(context.Background(), ObjectStorage)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Object Storage request failed: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && !(method == "DELETE" && resp.StatusCode == fsthttp.StatusNotFound) {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("index update failed: %d", resp.StatusCode), Detail: key, Status: fsthttp.StatusInternalServerError}
+	}
+	return nil
+}
+
+// markerExists reports whether a marker object exists
+func (ix *setIndex) markerExists(key string) (bool, error) {
+	req, err := SignHeadRequest(key)
+	if err != nil {
+		return false, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("S3 auth error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	req.CacheOptions.Pass = true
+
+	resp, err := req.Send(context.Background(), ObjectStorage)
+	if err != nil {
+		return false, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Object Storage request failed: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case fsthttp.StatusOK:
+		return true, nil
+	case fsthttp.StatusNotFound:
+		return false, nil
+	}
+	return false, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("index lookup failed: %d", resp.StatusCode), Detail: key, Status: fsthttp.StatusInternalServerError}
+}
+
+// listMarkers returns the members with a marker under base
+func (ix *setIndex) listMarkers(base string) ([]string, error) {
+	prefix := base + ix.prefix + "/"
+	var members []string
+	token := ""
+
+	for page := 0; page < MaxSetIndexPages; page++ {
+		req, err := SignListObjectsRequest(prefix, token)
+		if err != nil {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("S3 auth error: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
+		req.CacheOptions.Pass = true
+
+		resp, err := req.Send(context.Background(), ObjectStorage)
+		if err != nil {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Object Storage request failed: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != fsthttp.StatusOK {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("index listing failed: %d", resp.StatusCode), Detail: prefix, Status: fsthttp.StatusInternalServerError}
+		}
+
+		var result ListBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid index listing: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
+		for _, object := range result.Contents {
+			// Keys below the set belong to a nested set (e.g. a repository
+			// "a/b" under "a"), not to this one
+			name := strings.TrimPrefix(object.Key, prefix)
+			if strings.Contains(name, "/") {
+				continue
+			}
+			if member, err := hex.DecodeString(name); err == nil {
+				members = append(members, string(member))
+			}
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return members, nil
+		}
+		token = result.NextContinuationToken
+	}
+
+	return nil, &OCIError{Code: "UNSUPPORTED", Message: "index too large to list", Detail: prefix, Status: fsthttp.StatusInternalServerError}
+}
+
+// legacyMembers reads the members left in the pre-marker KV shard keys
+func (ix *setIndex) legacyMembers() []string {
+	var all []string
+	read := func(key string) {
+		entry, err := ix.store.Lookup(key)
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(entry)
+		var members []string
+		json.Unmarshal(body, &members)
+		all = append(all, members...)
+	}
+
+	for shard := 0; shard < KVIndexShards; shard++ {
+		read(fmt.Sprintf("%s/%02d", ix.prefix, shard))
+	}
+	if ix.legacyKey != "" {
+		read(ix.legacyKey)
+	}
+	return all
+}
@@ -0,0 +1,242 @@
+// Tag History and Rollback
+//
+// Records an append-only history of every digest a tag has pointed to, and
+// exposes it through registry extension endpoints:
+//
+//	GET  /v2/<name>/_edgeoci/tags/<tag>/history
+//	POST /v2/<name>/_edgeoci/tags/<tag>/rollback
+//
+// Each movement is its own KV key in the metadata store and its ID is its own
+// index marker, so concurrent pushes never overwrite each other's entries:
+//
+//	taghistory/<name>/<tag>/<unix-nanos>-<digest>  one entry
+//	taghistoryindex/<name>/<tag>                   entry IDs (see setindex.go)
+//
+// The entry is written before the tag moves, and a failure fails the push,
+// so the history never silently misses a movement. Only the newest
+// MaxTagHistoryEntries entries are read.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// Tag history actions
+	TagActionPush     = "push"
+	TagActionRollback = "rollback"
+
+	// Maximum history entries returned per tag (oldest are skipped first)
+	MaxTagHistoryEntries = 500
+)
+
+// TagHistoryEntry records a single tag movement
+type TagHistoryEntry struct {
+	Digest    string `json:"digest"`
+	Previous  string `json:"previous,omitempty"`
+	Action    string `json:"action"`
+	Account   string `json:"account"`
+	Timestamp string `json:"timestamp"`
+}
+
+// TagHistory response for the history endpoint (oldest entry first)
+type TagHistory struct {
+	Name    string            `json:"name"`
+	Tag     string            `json:"tag"`
+	Current string            `json:"current,omitempty"`
+	History []TagHistoryEntry `json:"history"`
+}
+
+// RollbackRequest is the body of a rollback request.
+// If Digest is empty the tag is moved back to the digest it pointed to before the current one.
+type RollbackRequest struct {
+	Digest string `json:"digest"`
+}
+
+// tagHistoryKey returns the key of one history entry
+func tagHistoryKey(name, tag, id string) string {
+	return fmt.Sprintf("taghistory/%s/%s/%s", name, tag, id)
+}
+
+// legacyTagHistoryKey is the pre-sharding JSON array of a tag's history
+func legacyTagHistoryKey(name, tag string) string {
+	return fmt.Sprintf("taghistory/%s/%s", name, tag)
+}
+
+// loadTagHistory loads the newest MaxTagHistoryEntries of a tag's history
+// (oldest first)
+func loadTagHistory(name, tag string) ([]TagHistoryEntry, error) {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	var history []TagHistoryEntry
+	if entry, err := store.Lookup(legacyTagHistoryKey(name, tag)); err == nil {
+		body, _ := io.ReadAll(entry)
+		json.Unmarshal(body, &history)
+	}
+
+	// IDs start with a fixed-width timestamp, so they sort chronologically
+	ids, err := tagHistoryIndex(store, name, tag).List()
+	if err != nil {
+		return nil, err
+	}
+	if skip := len(history) + len(ids) - MaxTagHistoryEntries; skip > 0 {
+		if skip >= len(history) {
+			ids = ids[skip-len(history):]
+			history = nil
+		} else {
+			history = history[skip:]
+		}
+	}
+
+	for _, id := range ids {
+		entry, err := store.Lookup(tagHistoryKey(name, tag, id))
+		if err != nil {
+			continue
+		}
+		body, _ := io.ReadAll(entry)
+		var record TagHistoryEntry
+		if err := json.Unmarshal(body, &record); err != nil {
+			continue
+		}
+		history = append(history, record)
+	}
+	return history, nil
+}
+
+// appendTagHistory records a tag movement under its own key
+func appendTagHistory(name, tag string, record TagHistoryEntry) error {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	now := time.Now().UTC()
+	if record.Timestamp == "" {
+		record.Timestamp = now.Format(time.RFC3339)
+	}
+	id := fmt.Sprintf("%019d-%s", now.UnixNano(), record.Digest)
+
+	value, _ := json.Marshal(record)
+	if err := store.Insert(tagHistoryKey(name, tag, id), strings.NewReader(string(value))); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	return tagHistoryIndex(store, name, tag).Add(id)
+}
+
+// handleTagHistory handles GET /v2/<name>/_edgeoci/tags/<tag>/history
+func handleTagHistory(_ context.Context, w fsthttp.ResponseWriter, name, tag string) error {
+	history, err := loadTagHistory(name, tag)
+	if err != nil {
+		return err
+	}
+
+	current, _ := resolveTag(name, tag)
+	if len(history) == 0 && current == "" {
+		return &OCIError{Code: "MANIFEST_UNKNOWN", Message: "tag unknown", Detail: tag, Status: fsthttp.StatusNotFound}
+	}
+
+	response := TagHistory{Name: name, Tag: tag, Current: current, History: history}
+	if response.History == nil {
+		response.History = []TagHistoryEntry{}
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	return nil
+}
+
+// handleTagRollback handles POST /v2/<name>/_edgeoci/tags/<tag>/rollback
+func handleTagRollback(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, name, tag, account string) error {
+	var req RollbackRequest
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if len(strings.TrimSpace(string(body))) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return &OCIError{Code: "UNSUPPORTED", Message: "invalid rollback request", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+		}
+	}
+
+	current, err := resolveTag(name, tag)
+	if err != nil {
+		return err
+	}
+
+	history, err := loadTagHistory(name, tag)
+	if err != nil {
+		return err
+	}
+
+	target := req.Digest
+	if target == "" {
+		// Default: the digest the tag pointed to before the current one
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Digest == current && history[i].Previous != "" {
+				target = history[i].Previous
+				break
+			}
+		}
+		if target == "" {
+			return &OCIError{Code: "UNSUPPORTED", Message: "no earlier digest recorded for tag", Detail: tag, Status: fsthttp.StatusConflict}
+		}
+	} else {
+		if err := ValidateDigestFormat(target); err != nil {
+			return err
+		}
+		known := false
+		for _, h := range history {
+			if h.Digest == target || h.Previous == target {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return &OCIError{Code: "MANIFEST_UNKNOWN", Message: "digest not found in tag history", Detail: target, Status: fsthttp.StatusNotFound}
+		}
+	}
+
+	if target == current {
+		w.Header().Set("Docker-Content-Digest", current)
+		w.WriteHeader(fsthttp.StatusNoContent)
+		return nil
+	}
+
+	// The target manifest must still exist
+	store, err := kvstore.Open(KVStoreManifests)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if _, err := store.Lookup(fmt.Sprintf("manifests/%s/%s", name, target)); err != nil {
+		return &OCIError{Code: "MANIFEST_UNKNOWN", Message: "manifest unknown", Detail: target, Status: fsthttp.StatusNotFound}
+	}
+
+	if err := checkTagMutable(name, tag, target); err != nil {
+		return err
+	}
+
+	if err := saveTag(name, tag, target, account, TagActionRollback); err != nil {
+		return err
+	}
+
+	LogSecurityEvent("TAG_ROLLBACK", "", fmt.Sprintf("repo=%s tag=%s from=%s to=%s account=%s", name, tag, current, target, account))
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, target))
+	w.Header().Set("Docker-Content-Digest", target)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(fsthttp.StatusCreated)
+	return nil
+}
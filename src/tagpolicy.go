@@ -0,0 +1,210 @@
+// Tag Immutability Policies
+//
+// Protects release tags from being moved once they have been pushed.
+// Policies live in the metadata KV store under "config/tag-policy" and are
+// matched per repository (or repository pattern). Tags that match an
+// immutable pattern can be re-pushed with the same digest, but never moved
+// to a different one.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// KV key (in the metadata store) holding the tag policy document
+	TagPolicyKey = "config/tag-policy"
+
+	// Special pattern matching semantic version tags (v1.2.3, 1.2.3-rc.1)
+	TagPatternSemver = "semver"
+)
+
+// semverTagPattern matches semver tags; "+" build metadata is not allowed in tags
+var semverTagPattern = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?$`)
+
+// TagPolicy is the stored tag immutability configuration
+//
+// Example:
+//
+//	{"rules":[
+//	  {"repository":"**","immutable":["semver"]},
+//	  {"repository":"prod/*","immutable":["release-*"],"mutable":["release-latest"]}
+//	]}
+type TagPolicy struct {
+	Rules []TagPolicyRule `json:"rules"`
+}
+
+// TagPolicyRule marks tag patterns as immutable for matching repositories
+type TagPolicyRule struct {
+	Repository string   `json:"repository"`        // Repository pattern ("*" = one path segment, "**" = any)
+	Immutable  []string `json:"immutable"`         // Tag globs or "semver"
+	Mutable    []string `json:"mutable,omitempty"` // Exceptions that stay movable (e.g. "latest")
+}
+
+// loadTagPolicy loads the tag policy from KV, returning an empty policy if none is configured
+func loadTagPolicy() (*TagPolicy, error) {
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	policy := &TagPolicy{}
+	entry, err := store.Lookup(TagPolicyKey)
+	if err != nil {
+		return policy, nil
+	}
+
+	body, _ := io.ReadAll(entry)
+	if err := json.Unmarshal(body, policy); err != nil {
+		return nil, &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Invalid tag policy: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	return policy, nil
+}
+
+// ImmutablePattern returns the pattern that makes a tag immutable, or "" if the tag is mutable
+func (p *TagPolicy) ImmutablePattern(repo, tag string) string {
+	for _, rule := range p.Rules {
+		if !matchRepositoryPattern(rule.Repository, repo) {
+			continue
+		}
+		if matchAnyTagPattern(rule.Mutable, tag) != "" {
+			continue
+		}
+		if pattern := matchAnyTagPattern(rule.Immutable, tag); pattern != "" {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// checkTagMutable returns a DENIED error if moving tag to digest would violate the tag policy.
+// Re-pushing the digest a tag already points to is always allowed.
+func checkTagMutable(name, tag, digest string) error {
+	policy, err := loadTagPolicy()
+	if err != nil {
+		return err
+	}
+
+	pattern := policy.ImmutablePattern(name, tag)
+	if pattern == "" {
+		return nil
+	}
+
+	current, err := resolveTag(name, tag)
+	if err != nil {
+		// Tag doesn't exist yet - first push is always allowed
+		return nil
+	}
+	if current == digest {
+		return nil
+	}
+
+	LogSecurityEvent("TAG_IMMUTABLE", "", fmt.Sprintf("repo=%s tag=%s current=%s attempted=%s", name, tag, current, digest))
+	return tagImmutableError(name, tag, pattern)
+}
+
+// checkDigestDeletable returns a DENIED error if an immutable tag points at
+// digest, since deleting the manifest would leave the tag dangling
+func checkDigestDeletable(name, digest string) error {
+	policy, err := loadTagPolicy()
+	if err != nil {
+		return err
+	}
+	if len(policy.Rules) == 0 {
+		return nil
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	tags, err := tagIndex(store, name).List()
+	if err != nil {
+		return err
+	}
+
+	// Only immutable tags need resolving
+	for _, tag := range tags {
+		pattern := policy.ImmutablePattern(name, tag)
+		if pattern == "" {
+			continue
+		}
+		if current, err := resolveTag(name, tag); err == nil && current == digest {
+			LogSecurityEvent("TAG_IMMUTABLE", "", fmt.Sprintf("repo=%s tag=%s delete=%s", name, tag, digest))
+			return tagImmutableError(name, tag, pattern)
+		}
+	}
+	return nil
+}
+
+// tagImmutableError builds the error returned when a protected tag would move
+func tagImmutableError(name, tag, pattern string) *OCIError {
+	return &OCIError{
+		Code:    "DENIED",
+		Message: fmt.Sprintf("tag %s is immutable in repository %s", tag, name),
+		Detail:  fmt.Sprintf("TAG_IMMUTABLE: tag matches immutable pattern %q", pattern),
+		Status:  fsthttp.StatusForbidden,
+	}
+}
+
+// matchAnyTagPattern returns the first pattern matching tag, or ""
+func matchAnyTagPattern(patterns []string, tag string) string {
+	for _, pattern := range patterns {
+		if matchTagPattern(pattern, tag) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// matchTagPattern matches a tag against a glob or the "semver" keyword
+func matchTagPattern(pattern, tag string) bool {
+	if pattern == TagPatternSemver {
+		return semverTagPattern.MatchString(tag)
+	}
+	matched, err := path.Match(pattern, tag)
+	return err == nil && matched
+}
+
+// matchRepositoryPattern matches a repository name against a pattern where
+// "*" matches within a single path segment and "**" matches any number of segments.
+// An empty pattern matches every repository.
+func matchRepositoryPattern(pattern, name string) bool {
+	if pattern == "" || pattern == "**" {
+		return true
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		matched, err := path.Match(pattern[0], name[0])
+		if err != nil || !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
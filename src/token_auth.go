@@ -5,12 +5,13 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -18,10 +19,20 @@ import (
 )
 
 const (
-	TokenIssuer        = "registry.aerosane.dev"
-	TokenExpiry        = 3600 // 1 hour in seconds
-	TokenSecretKey     = "TOKEN_SECRET_KEY"
-	DefaultTokenSecret = "fastly-oci-registry-token-secret-2024"
+	// Public hostname of the registry, used as token issuer and service and
+	// in the challenge realm. Local development (fastly compute serve) uses
+	// the request Host header instead.
+	RegistryHostname = "registry.aerosane.dev"
+
+	TokenExpiry    = 3600 // 1 hour in seconds
+	TokenSecretKey = "TOKEN_SECRET_KEY"
+
+	// Allowed clock skew between edge nodes when checking exp, nbf and iat
+	TokenClockLeeway = 30 // seconds
+
+	// Refresh tokens (see oauth.go) live much longer than access tokens
+	RefreshTokenExpiry = 90 * 24 * 3600 // 90 days in seconds
+	TokenUseRefresh    = "refresh"
 )
 
 // TokenRequest represents the token request parameters
@@ -33,10 +44,12 @@ type TokenRequest struct {
 
 // TokenResponse represents the token response
 type TokenResponse struct {
-	Token       string `json:"token"`
-	AccessToken string `json:"access_token,omitempty"`
-	ExpiresIn   int    `json:"expires_in"`
-	IssuedAt    string `json:"issued_at"`
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	ExpiresIn    int    `json:"expires_in"`
+	IssuedAt     string `json:"issued_at"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 // TokenClaims represents the JWT-like token claims
@@ -45,9 +58,13 @@ type TokenClaims struct {
 	Subject   string        `json:"sub"`
 	Audience  string        `json:"aud"`
 	ExpiresAt int64         `json:"exp"`
+	NotBefore int64         `json:"nbf,omitempty"`
 	IssuedAt  int64         `json:"iat"`
 	JWTID     string        `json:"jti"`
 	Access    []AccessEntry `json:"access"`
+	TokenUse  string        `json:"token_use,omitempty"` // "refresh" for refresh tokens, empty for access tokens
+	PAT       string        `json:"pat,omitempty"`       // Personal access token the token was exchanged for
+	Robot     bool          `json:"robot,omitempty"`     // Issued to a robot account
 }
 
 // AccessEntry represents a single access permission
@@ -59,46 +76,85 @@ type AccessEntry struct {
 
 // HandleTokenRequest handles GET/POST /v2/auth or /token endpoint
 func HandleTokenRequest(w fsthttp.ResponseWriter, r *fsthttp.Request) error {
-	service := r.URL.Query().Get("service")
-	scope := r.URL.Query().Get("scope")
-	account := r.URL.Query().Get("account")
+	if r.Method == "POST" {
+		return handleOAuthTokenRequest(w, r)
+	}
+
+	query := r.URL.Query()
+	account := query.Get("account")
+	service, err := resolveTokenService(r, query.Get("service"))
+	if err != nil {
+		return err
+	}
 
-	// Check Basic auth credentials
-	authResult := CheckAuth(r)
+	// Check Basic auth credentials; without any, issue an anonymous token
+	// that can only carry pull access to public repositories
+	authResult := CheckTokenEndpointAuth(r)
+	if !authResult.Authenticated && r.Header.Get("Authorization") == "" {
+		authResult = &AuthResult{Authenticated: true, Username: AnonymousAccount, Anonymous: true}
+	}
+	if authResult.RetryAfter > 0 {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", authResult.RetryAfter))
+		return authResult.Error
+	}
 	if !authResult.Authenticated {
-		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, TokenIssuer))
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, registryHost(r)))
 		w.Header().Set("Content-Type", ContentTypeJSON)
 		w.WriteHeader(fsthttp.StatusUnauthorized)
 		w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`))
 		return nil
 	}
 
-	if account == "" {
-		account = authResult.Username
+	// The token subject is always the authenticated account
+	if account != "" && account != authResult.Username {
+		LogSecurityEvent("TOKEN_ACCOUNT_MISMATCH", getClientIP(r), fmt.Sprintf("account=%s authenticated=%s", account, authResult.Username))
+		return &OCIError{
+			Code:    "DENIED",
+			Message: "account does not match the authenticated user",
+			Status:  fsthttp.StatusForbidden,
+		}
 	}
 
-	// Parse scope(s)
-	var accessEntries []AccessEntry
-	if scope != "" {
-		scopes := strings.Split(scope, " ")
-		for _, s := range scopes {
-			entry := parseScope(s)
-			if entry != nil {
-				accessEntries = append(accessEntries, *entry)
-			}
-		}
+	// offline_token=true asks for a refresh token, which only password logins may get
+	offline := query.Get("offline_token") == "true" && authResult.Claims == nil && !authResult.Anonymous && authResult.TokenID == "" && !authResult.Federated
+
+	return writeTokenResponse(w, r, authResult, service, parseScopes(query["scope"]), offline)
+}
+
+// writeTokenResponse issues an access token limited to the caller's grants
+// (and optionally a refresh token) and writes the token response
+func writeTokenResponse(w fsthttp.ResponseWriter, r *fsthttp.Request, auth *AuthResult, service string, requested []AccessEntry, withRefresh bool) error {
+	// Token issuance has its own budget per identity
+	budget := CheckOperationLimit(r, auth, OpToken, RateLimitCostUnit)
+	setRateLimitHeaders(w, budget)
+	if !budget.Allowed {
+		LogSecurityEvent("RATE_LIMIT", getClientIP(r), fmt.Sprintf("op=%s account=%s exceeded %d requests", OpToken, auth.Username, budget.Limit))
+		WriteRateLimitResponse(w, budget)
+		return nil
+	}
+
+	// Only grant what the account is permitted
+	accessEntries := intersectScopes(auth, requested)
+
+	// Federated identities get short-lived tokens
+	expiresIn := TokenExpiry
+	if auth.Federated {
+		expiresIn = FederatedTokenExpiry
 	}
 
 	// Generate token
 	now := time.Now().UTC()
 	claims := TokenClaims{
-		Issuer:    TokenIssuer,
-		Subject:   account,
+		Issuer:    registryHost(r),
+		Subject:   auth.Username,
 		Audience:  service,
-		ExpiresAt: now.Add(time.Duration(TokenExpiry) * time.Second).Unix(),
+		ExpiresAt: now.Add(time.Duration(expiresIn) * time.Second).Unix(),
+		NotBefore: now.Unix(),
 		IssuedAt:  now.Unix(),
 		JWTID:     generateTokenID(),
 		Access:    accessEntries,
+		PAT:       auth.TokenID,
+		Robot:     auth.Robot,
 	}
 
 	token, err := generateToken(claims)
@@ -113,19 +169,64 @@ func HandleTokenRequest(w fsthttp.ResponseWriter, r *fsthttp.Request) error {
 	response := TokenResponse{
 		Token:       token,
 		AccessToken: token,
-		ExpiresIn:   TokenExpiry,
+		Scope:       formatScopes(accessEntries),
+		ExpiresIn:   expiresIn,
 		IssuedAt:    now.Format(time.RFC3339),
 	}
 
+	if withRefresh {
+		refresh, err := generateToken(TokenClaims{
+			Issuer:    registryHost(r),
+			Subject:   auth.Username,
+			Audience:  service,
+			ExpiresAt: now.Add(time.Duration(RefreshTokenExpiry) * time.Second).Unix(),
+			NotBefore: now.Unix(),
+			IssuedAt:  now.Unix(),
+			JWTID:     generateTokenID(),
+			TokenUse:  TokenUseRefresh,
+		})
+		if err != nil {
+			return &OCIError{
+				Code:    "UNSUPPORTED",
+				Message: "failed to generate refresh token",
+				Status:  fsthttp.StatusInternalServerError,
+			}
+		}
+		response.RefreshToken = refresh
+	}
+
 	w.Header().Set("Content-Type", ContentTypeJSON)
 	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(fsthttp.StatusOK)
 	json.NewEncoder(w).Encode(response)
 
-	LogSecurityEvent("TOKEN_ISSUED", "", fmt.Sprintf("account=%s service=%s scopes=%d", account, service, len(accessEntries)))
+	LogSecurityEvent("TOKEN_ISSUED", "", fmt.Sprintf("account=%s service=%s scopes=%d/%d refresh=%t", auth.Username, service, len(accessEntries), len(requested), withRefresh))
 	return nil
 }
 
+// parseScopes parses scope parameters: repeated values, each possibly space-separated
+func parseScopes(values []string) []AccessEntry {
+	var requested []AccessEntry
+	for _, scope := range values {
+		for _, s := range strings.Fields(scope) {
+			entry := parseScope(s)
+			if entry != nil {
+				requested = append(requested, *entry)
+			}
+		}
+	}
+	return requested
+}
+
+// formatScopes renders access entries as a space-separated scope string
+func formatScopes(entries []AccessEntry) string {
+	scopes := make([]string, 0, len(entries))
+	for _, e := range entries {
+		scopes = append(scopes, fmt.Sprintf("%s:%s:%s", e.Type, e.Name, strings.Join(e.Actions, ",")))
+	}
+	return strings.Join(scopes, " ")
+}
+
 // parseScope parses a scope string like "repository:library/ubuntu:pull,push"
 func parseScope(scope string) *AccessEntry {
 	parts := strings.SplitN(scope, ":", 3)
@@ -145,8 +246,14 @@ func parseScope(scope string) *AccessEntry {
 	return entry
 }
 
-// generateToken creates a signed token from claims
+// generateToken creates a signed token from claims using the active signing key
 func generateToken(claims TokenClaims) (string, error) {
+	keys, err := loadTokenKeys()
+	if err != nil {
+		return "", err
+	}
+	key := keys.ActiveKey()
+
 	claimsJSON, err := json.Marshal(claims)
 	if err != nil {
 		return "", err
@@ -154,7 +261,8 @@ func generateToken(claims TokenClaims) (string, error) {
 
 	header := map[string]string{
 		"typ": "JWT",
-		"alg": "HS256",
+		"alg": key.Alg,
+		"kid": key.KID,
 	}
 	headerJSON, _ := json.Marshal(header)
 
@@ -162,35 +270,73 @@ func generateToken(claims TokenClaims) (string, error) {
 	claimsB64 := base64.RawURLEncoding.EncodeToString(claimsJSON)
 
 	message := headerB64 + "." + claimsB64
-	signature := signMessage(message)
+	signature, err := key.Sign(message)
+	if err != nil {
+		return "", err
+	}
 	signatureB64 := base64.RawURLEncoding.EncodeToString(signature)
 
 	return message + "." + signatureB64, nil
 }
 
-// signMessage signs a message with HMAC-SHA256
-func signMessage(message string) []byte {
-	secret := getTokenSecret()
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(message))
-	return h.Sum(nil)
+// generateTokenID generates a unique token ID
+func generateTokenID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-// getTokenSecret gets the token signing secret from Secret Store
-func getTokenSecret() string {
-	// TODO: Load from Secret Store in production
-	return DefaultTokenSecret
+// registryHost returns the registry's public hostname, which is both the
+// token issuer and the service tokens are issued for. Outside local mode it
+// is always RegistryHostname: deriving it from Host would let the iss and aud
+// checks accept tokens minted under any name the service answers to.
+func registryHost(r *fsthttp.Request) string {
+	if !isLocalMode() {
+		return RegistryHostname
+	}
+	host := strings.ToLower(r.Host)
+	if host == "" || strings.Trim(host, "abcdefghijklmnopqrstuvwxyz0123456789.-:[]") != "" {
+		// Never reflect a malformed Host header into challenges or tokens
+		return "localhost"
+	}
+	return host
 }
 
-// generateTokenID generates a unique token ID
-func generateTokenID() string {
-	now := time.Now().UnixNano()
-	h := sha256.Sum256([]byte(fmt.Sprintf("%d", now)))
-	return hex.EncodeToString(h[:8])
+// isLocalMode reports whether the service runs under fastly compute serve
+func isLocalMode() bool {
+	return os.Getenv("FASTLY_HOSTNAME") == "localhost"
 }
 
-// ValidateBearerToken validates a Bearer token
-func ValidateBearerToken(token string) (*TokenClaims, error) {
+// tokenRealm returns the URL of the token endpoint for auth challenges.
+// Local hosts (fastly compute serve) are served over plain http.
+func tokenRealm(r *fsthttp.Request) string {
+	host := registryHost(r)
+	hostname := host
+	if u, err := url.Parse("//" + host); err == nil {
+		hostname = u.Hostname()
+	}
+	scheme := "https"
+	if hostname == "localhost" || hostname == "127.0.0.1" || hostname == "::1" || strings.HasSuffix(hostname, ".localhost") {
+		scheme = "http"
+	}
+	return scheme + "://" + host + "/v2/auth"
+}
+
+// resolveTokenService checks the service a token is requested for; tokens
+// are only issued for this registry
+func resolveTokenService(r *fsthttp.Request, service string) (string, error) {
+	if service == "" {
+		return registryHost(r), nil
+	}
+	if service != registryHost(r) {
+		return "", &OCIError{Code: "UNSUPPORTED", Message: "unknown service", Detail: service, Status: fsthttp.StatusBadRequest}
+	}
+	return service, nil
+}
+
+// ValidateBearerToken validates a Bearer token issued by this registry for
+// the registry host of the request
+func ValidateBearerToken(r *fsthttp.Request, token string) (*TokenClaims, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
 		return nil, fmt.Errorf("invalid token format")
@@ -198,12 +344,36 @@ func ValidateBearerToken(token string) (*TokenClaims, error) {
 
 	headerB64, claimsB64, signatureB64 := parts[0], parts[1], parts[2]
 
+	// Select the signing key by kid
+	headerJSON, err := base64.RawURLEncoding.DecodeString(headerB64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid header encoding")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		KID string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("invalid header JSON")
+	}
+
+	keys, err := loadTokenKeys()
+	if err != nil {
+		return nil, fmt.Errorf("no signing key configured")
+	}
+	key := keys.Key(header.KID)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key")
+	}
+	// The algorithm is fixed by the key, never chosen by the token
+	if header.Alg != key.Alg {
+		return nil, fmt.Errorf("unexpected signing algorithm %q", header.Alg)
+	}
+
 	// Verify signature
 	message := headerB64 + "." + claimsB64
-	expectedSig := signMessage(message)
-	expectedSigB64 := base64.RawURLEncoding.EncodeToString(expectedSig)
-
-	if !SecureCompare(signatureB64, expectedSigB64) {
+	signature, err := base64.RawURLEncoding.DecodeString(signatureB64)
+	if err != nil || !key.Verify(message, signature) {
 		return nil, fmt.Errorf("invalid signature")
 	}
 
@@ -218,10 +388,25 @@ func ValidateBearerToken(token string) (*TokenClaims, error) {
 		return nil, fmt.Errorf("invalid claims JSON")
 	}
 
-	// Check expiration
-	if time.Now().Unix() > claims.ExpiresAt {
+	// Check issuer, audience and validity window
+	if claims.Issuer != registryHost(r) {
+		return nil, fmt.Errorf("unexpected issuer")
+	}
+	if claims.Audience != registryHost(r) {
+		return nil, fmt.Errorf("token was issued for another service")
+	}
+	now := time.Now().Unix()
+	if now > claims.ExpiresAt+TokenClockLeeway {
 		return nil, fmt.Errorf("token expired")
 	}
+	if now+TokenClockLeeway < claims.NotBefore || now+TokenClockLeeway < claims.IssuedAt {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+
+	// Check the revocation list
+	if tokenRevoked(&claims) {
+		return nil, errTokenRevoked
+	}
 
 	return &claims, nil
 }
@@ -234,7 +419,13 @@ func CheckBearerAuth(r *fsthttp.Request) *AuthResult {
 	}
 
 	token := strings.TrimPrefix(authHeader, "Bearer ")
-	claims, err := ValidateBearerToken(token)
+	claims, err := ValidateBearerToken(r, token)
+	if err == nil && claims.TokenUse != "" {
+		err = fmt.Errorf("refresh tokens cannot be used for registry access")
+	}
+	if err == nil && claims.PAT != "" && !accessTokenActive(claims.PAT) {
+		err = fmt.Errorf("access token revoked or expired")
+	}
 	if err != nil {
 		return &AuthResult{
 			Authenticated: false,
@@ -249,21 +440,28 @@ func CheckBearerAuth(r *fsthttp.Request) *AuthResult {
 	return &AuthResult{
 		Authenticated: true,
 		Username:      claims.Subject,
+		Robot:         claims.Robot,
 		Claims:        claims,
 	}
 }
 
 // CheckAuthorization validates token permissions for the action
 func CheckAuthorization(claims *TokenClaims, repoName, action string) bool {
+	return checkAccess(claims, ScopeTypeRepository, repoName, action)
+}
+
+// checkAccess reports whether claims grant action on a resource. The name
+// "*" covers every repository; registry resources must be named exactly.
+func checkAccess(claims *TokenClaims, resourceType, name, action string) bool {
 	if claims == nil {
 		return true
 	}
 
 	for _, access := range claims.Access {
-		if access.Type != "repository" {
+		if access.Type != resourceType {
 			continue
 		}
-		if access.Name != repoName && access.Name != "*" {
+		if access.Name != name && !(resourceType == ScopeTypeRepository && access.Name == "*") {
 			continue
 		}
 		for _, permitted := range access.Actions {
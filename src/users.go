@@ -0,0 +1,589 @@
+// User Accounts
+//
+// Registry accounts live in the metadata KV store under "users/<name>",
+// enumerable through a sharded user index. Passwords are stored only as
+// PBKDF2-SHA256 hashes ("pbkdf2-sha256$<iterations>$<salt>$<hash>").
+//
+// The REGISTRY_USERNAME/REGISTRY_PASSWORD Secret Store pair remains as the
+// bootstrap administrator, so a fresh registry can create its first users.
+//
+// Robot accounts have no password and authenticate only with personal
+// access tokens (accesstokens.go).
+//
+// Administrators (the bootstrap account or members of the "admin" group)
+// manage accounts through registry extension endpoints:
+//
+//	GET    /v2/_edgeoci/users
+//	GET    /v2/_edgeoci/users/<name>
+//	PUT    /v2/_edgeoci/users/<name>
+//	DELETE /v2/_edgeoci/users/<name>
+//	POST   /v2/_edgeoci/users/<name>/password   (also allowed for the user themself)
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fastly/compute-sdk-go/fsthttp"
+	"github.com/fastly/compute-sdk-go/kvstore"
+)
+
+const (
+	// Group whose members may manage accounts
+	AdminGroup = "admin"
+
+	// Password hashing parameters
+	PasswordHashScheme     = "pbkdf2-sha256"
+	PasswordHashIterations = 100000
+	PasswordSaltLength     = 16
+	PasswordKeyLength      = 32
+
+	// Password and group limits
+	MinPasswordLength = 12
+	MaxPasswordLength = 256
+	MaxUserGroups     = 32
+)
+
+var accountNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// UserAccount is a stored registry account ("users/<name>")
+type UserAccount struct {
+	Username     string   `json:"username"`
+	PasswordHash string   `json:"password_hash"`
+	Robot        bool     `json:"robot,omitempty"`
+	Disabled     bool     `json:"disabled,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	CreatedAt    string   `json:"created_at"`
+	UpdatedAt    string   `json:"updated_at,omitempty"`
+	UpdatedBy    string   `json:"updated_by,omitempty"`
+}
+
+// UserInfo is an account as returned by the admin API (no password hash)
+type UserInfo struct {
+	Username  string   `json:"username"`
+	Robot     bool     `json:"robot"`
+	Disabled  bool     `json:"disabled"`
+	Groups    []string `json:"groups"`
+	CreatedAt string   `json:"created_at,omitempty"`
+	UpdatedAt string   `json:"updated_at,omitempty"`
+	UpdatedBy string   `json:"updated_by,omitempty"`
+}
+
+// UserList response for GET /v2/_edgeoci/users
+type UserList struct {
+	Users []UserInfo `json:"users"`
+}
+
+// UserUpdate is the body of a user PUT. Omitted fields keep their value;
+// a password is required when creating an account, unless it is a robot.
+type UserUpdate struct {
+	Robot    *bool     `json:"robot"` // Only when creating
+	Password *string   `json:"password"`
+	Groups   *[]string `json:"groups"`
+	Disabled *bool     `json:"disabled"`
+}
+
+// PasswordUpdate is the body of a password reset. Users changing their own
+// password must also supply the current one.
+type PasswordUpdate struct {
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password,omitempty"`
+}
+
+// Verified password cache: hashing is deliberately slow, so a successful
+// check is remembered per instance. Keys cover the stored hash, so a
+// password change invalidates them.
+var (
+	verifiedPasswords   = make(map[string]bool)
+	verifiedPasswordsMu sync.Mutex
+)
+
+func userKey(name string) string {
+	return fmt.Sprintf("users/%s", name)
+}
+
+func (u *UserAccount) info() UserInfo {
+	groups := u.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+	return UserInfo{
+		Username:  u.Username,
+		Robot:     u.Robot,
+		Disabled:  u.Disabled,
+		Groups:    groups,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		UpdatedBy: u.UpdatedBy,
+	}
+}
+
+// InGroup reports whether the account is a member of group
+func (u *UserAccount) InGroup(group string) bool {
+	for _, g := range u.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// loadUser loads a stored account (nil if it doesn't exist)
+func loadUser(store *kvstore.Store, name string) *UserAccount {
+	entry, err := store.Lookup(userKey(name))
+	if err != nil {
+		return nil
+	}
+	body, _ := io.ReadAll(entry)
+	var user UserAccount
+	if json.Unmarshal(body, &user) != nil || user.Username == "" {
+		return nil
+	}
+	return &user
+}
+
+// saveUser stores an account and adds it to the user index
+func saveUser(store *kvstore.Store, user *UserAccount) error {
+	value, _ := json.Marshal(user)
+	if err := store.Insert(userKey(user.Username), strings.NewReader(string(value))); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV insert error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	return userIndex(store).Add(user.Username)
+}
+
+// authenticateUser checks credentials against the bootstrap account and the
+// user store, returning the account's groups on success
+func authenticateUser(username, password string) (groups []string, ok bool) {
+	if validateCredentials(username, password) {
+		return []string{AdminGroup}, true
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, false
+	}
+	user := loadUser(store, username)
+	if user == nil || !verifyPassword(user.PasswordHash, password) {
+		return nil, false
+	}
+	if user.Disabled {
+		LogSecurityEvent("AUTH_DISABLED", "", fmt.Sprintf("user=%s", username))
+		return nil, false
+	}
+	return user.Groups, true
+}
+
+// lookupAccount returns an enabled account without checking a password
+// (for credentials that were verified earlier, e.g. refresh tokens)
+func lookupAccount(username string) (*UserAccount, bool) {
+	if bootstrap, _, found := loadBootstrapCredentials(); found && SecureCompare(username, bootstrap) {
+		return &UserAccount{Username: username, Groups: []string{AdminGroup}}, true
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return nil, false
+	}
+	user := loadUser(store, username)
+	if user == nil || user.Disabled {
+		return nil, false
+	}
+	return user, true
+}
+
+// isAdmin reports whether the caller may manage accounts. Administration
+// needs a password login or a bearer token scoped to registry:admin; access
+// tokens act with their owner's repository access only.
+func isAdmin(auth *AuthResult) bool {
+	if !AuthEnabled {
+		return true
+	}
+	// Bearer tokens carry admin rights only as the registry:admin scope
+	if auth.Claims != nil {
+		return checkAccess(auth.Claims, ScopeTypeRegistry, RegistryAdmin, "*")
+	}
+	if auth.TokenID != "" {
+		return false
+	}
+	for _, g := range auth.Groups {
+		if g == AdminGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// hashPassword returns a PBKDF2-SHA256 hash string for password
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, PasswordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2SHA256([]byte(password), salt, PasswordHashIterations, PasswordKeyLength)
+	return fmt.Sprintf("%s$%d$%s$%s", PasswordHashScheme, PasswordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks password against a stored hash string
+func verifyPassword(stored, password string) bool {
+	cacheKey := sha256.Sum256([]byte(stored + "\x00" + password))
+	cacheID := hex.EncodeToString(cacheKey[:])
+	verifiedPasswordsMu.Lock()
+	cached := verifiedPasswords[cacheID]
+	verifiedPasswordsMu.Unlock()
+	if cached {
+		return true
+	}
+
+	parts := strings.Split(stored, "$")
+	if len(parts) != 4 || parts[0] != PasswordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, iterations, len(expected))
+	if !hmac.Equal(key, expected) {
+		return false
+	}
+
+	verifiedPasswordsMu.Lock()
+	verifiedPasswords[cacheID] = true
+	verifiedPasswordsMu.Unlock()
+	return true
+}
+
+// pbkdf2SHA256 derives a key with PBKDF2 (RFC 8018) using HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	derived := make([]byte, 0, blocks*hashLen)
+	var counter [4]byte
+	u := make([]byte, hashLen)
+	t := make([]byte, hashLen)
+
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		derived = append(derived, t...)
+	}
+	return derived[:keyLen]
+}
+
+// validatePassword checks password length limits
+func validatePassword(password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return &OCIError{
+			Code:    "UNSUPPORTED",
+			Message: fmt.Sprintf("password must be %d to %d characters", MinPasswordLength, MaxPasswordLength),
+			Status:  fsthttp.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+// validateGroups checks group names and count
+func validateGroups(groups []string) error {
+	if len(groups) > MaxUserGroups {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("at most %d groups allowed", MaxUserGroups), Status: fsthttp.StatusBadRequest}
+	}
+	for _, g := range groups {
+		if !accountNamePattern.MatchString(g) {
+			return &OCIError{Code: "UNSUPPORTED", Message: "invalid group name", Detail: g, Status: fsthttp.StatusBadRequest}
+		}
+	}
+	return nil
+}
+
+// validateAccountName checks an account name from the request path
+func validateAccountName(name string) error {
+	if !accountNamePattern.MatchString(name) || name == AnonymousAccount || name == OIDCLoginUsername {
+		return &OCIError{
+			Code:    "UNSUPPORTED",
+			Message: "invalid user name, expected [a-z0-9][a-z0-9._-]{0,63}",
+			Detail:  name,
+			Status:  fsthttp.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+func userUnknownError(name string) error {
+	return &OCIError{Code: "NAME_UNKNOWN", Message: "user unknown", Detail: name, Status: fsthttp.StatusNotFound}
+}
+
+func robotPasswordError(name string) error {
+	return &OCIError{Code: "UNSUPPORTED", Message: "robot accounts have no password, use access tokens", Detail: name, Status: fsthttp.StatusBadRequest}
+}
+
+func adminRequiredError() error {
+	return &OCIError{Code: "DENIED", Message: "administrator access required", Status: fsthttp.StatusForbidden}
+}
+
+// handleListUsers handles GET /v2/_edgeoci/users
+func handleListUsers(_ context.Context, w fsthttp.ResponseWriter, auth *AuthResult) error {
+	if !isAdmin(auth) {
+		return adminRequiredError()
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	names, err := userIndex(store).List()
+	if err != nil {
+		return err
+	}
+
+	response := UserList{Users: []UserInfo{}}
+	for _, name := range names {
+		if user := loadUser(store, name); user != nil {
+			response.Users = append(response.Users, user.info())
+		}
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(response)
+	return nil
+}
+
+// handleGetUser handles GET /v2/_edgeoci/users/<name>
+func handleGetUser(_ context.Context, w fsthttp.ResponseWriter, name string, auth *AuthResult) error {
+	if !isAdmin(auth) && auth.Username != name {
+		return adminRequiredError()
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	user := loadUser(store, name)
+	if user == nil {
+		return userUnknownError(name)
+	}
+
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(fsthttp.StatusOK)
+	json.NewEncoder(w).Encode(user.info())
+	return nil
+}
+
+// handlePutUser handles PUT /v2/_edgeoci/users/<name> (create or update)
+func handlePutUser(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, name string, auth *AuthResult) error {
+	if !isAdmin(auth) {
+		return adminRequiredError()
+	}
+
+	if bootstrap, _, ok := loadBootstrapCredentials(); ok && bootstrap == name {
+		return &OCIError{Code: "DENIED", Message: "the bootstrap account is managed in Secret Store", Detail: name, Status: fsthttp.StatusConflict}
+	}
+
+	var update UserUpdate
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if err := json.Unmarshal(body, &update); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: "invalid user update", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	user := loadUser(store, name)
+	created := user == nil
+	if created {
+		user = &UserAccount{Username: name, CreatedAt: now, Robot: update.Robot != nil && *update.Robot}
+		if update.Password == nil && !user.Robot {
+			return &OCIError{Code: "UNSUPPORTED", Message: "password is required for a new user", Status: fsthttp.StatusBadRequest}
+		}
+	} else if update.Robot != nil && *update.Robot != user.Robot {
+		return &OCIError{Code: "UNSUPPORTED", Message: "robot can only be set when creating an account", Status: fsthttp.StatusBadRequest}
+	}
+
+	if update.Password != nil && user.Robot {
+		return robotPasswordError(name)
+	}
+	if update.Password != nil {
+		if err := validatePassword(*update.Password); err != nil {
+			return err
+		}
+		hash, err := hashPassword(*update.Password)
+		if err != nil {
+			return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("password hashing failed: %v", err), Status: fsthttp.StatusInternalServerError}
+		}
+		user.PasswordHash = hash
+	}
+	if update.Groups != nil {
+		if err := validateGroups(*update.Groups); err != nil {
+			return err
+		}
+		user.Groups = *update.Groups
+	}
+	if update.Disabled != nil {
+		user.Disabled = *update.Disabled
+	}
+	user.UpdatedAt = now
+	user.UpdatedBy = auth.Username
+
+	if err := saveUser(store, user); err != nil {
+		return err
+	}
+	// A new password or a disabled account ends the sessions issued before it
+	if !created && (update.Password != nil || user.Disabled) {
+		if err := revokeSubjectTokens(store, name, auth.Username); err != nil {
+			return err
+		}
+	}
+
+	LogSecurityEvent("USER_UPDATED", "", fmt.Sprintf("user=%s created=%t robot=%t disabled=%t groups=%v by=%s", name, created, user.Robot, user.Disabled, user.Groups, auth.Username))
+
+	status := fsthttp.StatusOK
+	if created {
+		status = fsthttp.StatusCreated
+	}
+	w.Header().Set("Content-Type", ContentTypeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(user.info())
+	return nil
+}
+
+// handleDeleteUser handles DELETE /v2/_edgeoci/users/<name>
+func handleDeleteUser(_ context.Context, w fsthttp.ResponseWriter, name string, auth *AuthResult) error {
+	if !isAdmin(auth) {
+		return adminRequiredError()
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	if loadUser(store, name) == nil {
+		return userUnknownError(name)
+	}
+	if err := store.Delete(userKey(name)); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV delete error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if err := userIndex(store).Remove(name); err != nil {
+		return err
+	}
+	if err := revokeAccountTokens(store, name); err != nil {
+		return err
+	}
+	if err := revokeSubjectTokens(store, name, auth.Username); err != nil {
+		return err
+	}
+
+	LogSecurityEvent("USER_DELETED", "", fmt.Sprintf("user=%s by=%s", name, auth.Username))
+
+	w.WriteHeader(fsthttp.StatusAccepted)
+	return nil
+}
+
+// handleResetPassword handles POST /v2/_edgeoci/users/<name>/password
+func handleResetPassword(_ context.Context, w fsthttp.ResponseWriter, r *fsthttp.Request, name string, auth *AuthResult) error {
+	// Access and bearer tokens carry the owner's name but not their password
+	if err := requirePasswordLogin(auth); err != nil {
+		return err
+	}
+	admin := isAdmin(auth)
+	if !admin && auth.Username != name {
+		return adminRequiredError()
+	}
+
+	var update PasswordUpdate
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("Read body error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	if err := json.Unmarshal(body, &update); err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: "invalid password update", Detail: err.Error(), Status: fsthttp.StatusBadRequest}
+	}
+	if err := validatePassword(update.Password); err != nil {
+		return err
+	}
+
+	store, err := kvstore.Open(KVStoreMetadata)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("KV store error: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+
+	user := loadUser(store, name)
+	if user == nil {
+		return userUnknownError(name)
+	}
+	if user.Robot {
+		return robotPasswordError(name)
+	}
+	if !admin && (update.CurrentPassword == "" || !verifyPassword(user.PasswordHash, update.CurrentPassword)) {
+		LogSecurityEvent("PASSWORD_RESET_DENIED", getClientIP(r), fmt.Sprintf("user=%s", name))
+		return &OCIError{Code: "DENIED", Message: "current password is incorrect", Status: fsthttp.StatusForbidden}
+	}
+
+	hash, err := hashPassword(update.Password)
+	if err != nil {
+		return &OCIError{Code: "UNSUPPORTED", Message: fmt.Sprintf("password hashing failed: %v", err), Status: fsthttp.StatusInternalServerError}
+	}
+	user.PasswordHash = hash
+	user.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	user.UpdatedBy = auth.Username
+
+	if err := saveUser(store, user); err != nil {
+		return err
+	}
+	// Refresh and bearer tokens issued under the old password stop working
+	if err := revokeSubjectTokens(store, name, auth.Username); err != nil {
+		return err
+	}
+
+	LogSecurityEvent("PASSWORD_RESET", "", fmt.Sprintf("user=%s by=%s", name, auth.Username))
+
+	w.WriteHeader(fsthttp.StatusNoContent)
+	return nil
+}
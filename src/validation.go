@@ -22,6 +22,7 @@ type OCIManifest struct {
 	Config        *OCIDescriptor  `json:"config,omitempty"`
 	Layers        []OCIDescriptor `json:"layers,omitempty"`
 	Manifests     []OCIDescriptor `json:"manifests,omitempty"` // For index
+	Blobs         []OCIDescriptor `json:"blobs,omitempty"`     // For artifact manifests
 	Subject       *OCIDescriptor  `json:"subject,omitempty"`   // OCI 1.1
 	ArtifactType  string          `json:"artifactType,omitempty"` // OCI 1.1
 	Annotations   map[string]string `json:"annotations,omitempty"`
@@ -85,6 +86,11 @@ func ValidateManifest(data []byte, contentType string) (*OCIManifest, error) {
 		}
 	}
 
+	// Artifact manifests (OCI 1.1 RC) have no schemaVersion
+	if isArtifactManifest(contentType) {
+		return validateArtifactManifest(&manifest)
+	}
+
 	// Validate schemaVersion
 	if manifest.SchemaVersion != 2 {
 		return nil, &OCIError{
@@ -103,6 +109,9 @@ func ValidateManifest(data []byte, contentType string) (*OCIManifest, error) {
 		return validateImageIndex(&manifest)
 	default:
 		// Unknown type, just do basic validation
+		if err := validateSubject(&manifest); err != nil {
+			return nil, err
+		}
 		return &manifest, nil
 	}
 }
@@ -119,6 +128,11 @@ func isImageIndex(contentType string) bool {
 		strings.Contains(contentType, "image.index")
 }
 
+// isArtifactManifest checks if content type is an OCI artifact manifest
+func isArtifactManifest(contentType string) bool {
+	return strings.Contains(contentType, "artifact.manifest")
+}
+
 // validateImageManifest validates a single image manifest
 func validateImageManifest(manifest *OCIManifest) (*OCIManifest, error) {
 	// Config is required for image manifests
@@ -142,11 +156,8 @@ func validateImageManifest(manifest *OCIManifest) (*OCIManifest, error) {
 		}
 	}
 
-	// Validate subject if present (OCI 1.1)
-	if manifest.Subject != nil {
-		if err := validateDescriptor(manifest.Subject, "subject"); err != nil {
-			return nil, err
-		}
+	if err := validateSubject(manifest); err != nil {
+		return nil, err
 	}
 
 	return manifest, nil
@@ -170,9 +181,56 @@ func validateImageIndex(manifest *OCIManifest) (*OCIManifest, error) {
 		}
 	}
 
+	if err := validateSubject(manifest); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// validateArtifactManifest validates an OCI artifact manifest
+func validateArtifactManifest(manifest *OCIManifest) (*OCIManifest, error) {
+	if manifest.ArtifactType == "" {
+		return nil, &OCIError{
+			Code:    "MANIFEST_INVALID",
+			Message: "artifact manifest must have an artifactType",
+			Status:  fsthttp.StatusBadRequest,
+		}
+	}
+
+	for i, blob := range manifest.Blobs {
+		if err := validateDescriptor(&blob, fmt.Sprintf("blobs[%d]", i)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateSubject(manifest); err != nil {
+		return nil, err
+	}
+
 	return manifest, nil
 }
 
+// validateSubject validates the subject descriptor if present (OCI 1.1).
+// Any manifest kind may carry a subject.
+func validateSubject(manifest *OCIManifest) error {
+	if manifest.Subject == nil {
+		return nil
+	}
+	if err := validateDescriptor(manifest.Subject, "subject"); err != nil {
+		return err
+	}
+	if err := ValidateDigestFormat(manifest.Subject.Digest); err != nil {
+		return &OCIError{
+			Code:    "MANIFEST_INVALID",
+			Message: "subject.digest must be a valid sha256 digest",
+			Detail:  manifest.Subject.Digest,
+			Status:  fsthttp.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
 // validateDescriptor validates a content descriptor
 func validateDescriptor(desc *OCIDescriptor, name string) error {
 	if desc.MediaType == "" {
@@ -225,6 +283,10 @@ func VerifyBlobsExist(ctx context.Context, manifest *OCIManifest) error {
 		digests = append(digests, layer.Digest)
 	}
 
+	for _, blob := range manifest.Blobs {
+		digests = append(digests, blob.Digest)
+	}
+
 	// Limit checks to avoid hitting backend request limit
 	// Each check uses 1 backend request, and we have 32 max
 	maxChecks := 10